@@ -0,0 +1,47 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Number of CPUs the process is allowed to run on, fewer than the system
+// has when it was pinned with taskset or a cgroup cpuset
+func cpuAffinity() (int, error) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return 0, err
+	}
+	return set.Count(), nil
+}
+
+// List of CPUs local to the network card behind an interface, in the
+// format taskset -c accepts
+func localCPUs(iface string) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/device/local_cpulist", iface))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build amqp
+// +build amqp
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publishes the results as a persistent message, waiting for the broker to
+// confirm it
+func (a *amqpWriter) publish(id string, data []byte) error {
+	dial := amqp.Dial
+	if strings.HasPrefix(a.url, "amqps://") {
+		config, err := outputTLSConfig(a.caCert, a.cert, a.key)
+		if err != nil {
+			return err
+		}
+		dial = func(url string) (*amqp.Connection, error) {
+			return amqp.DialTLS(url, config)
+		}
+	}
+	conn, err := dial(a.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), amqpTimeout)
+	defer cancel()
+	err = ch.PublishWithContext(ctx, a.exchange, a.routingKey, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    id,
+		Timestamp:    time.Now(),
+		AppId:        "speedtest",
+		Body:         data,
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case confirm := <-confirms:
+		if !confirm.Ack {
+			return errors.New("broker did not accept the results")
+		}
+		return nil
+	case <-ctx.Done():
+		return errors.New("timed out waiting for the broker to confirm the results")
+	}
+}
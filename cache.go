@@ -0,0 +1,62 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Location of the server list saved by the last run, used to complete server
+// IDs without fetching the list again
+func serverCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "speedtest", "servers.xml"), nil
+}
+
+// Saves the server list as retrieved from speedtest.net
+func saveServerCache(body []byte) error {
+	path, err := serverCachePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, body, 0644)
+}
+
+// Loads the server list saved by the last run
+func loadServerCache() (*Servers, error) {
+	path, err := serverCachePath()
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var servers Servers
+	if err := xml.Unmarshal(body, &servers); err != nil {
+		return nil, err
+	}
+	return &servers, nil
+}
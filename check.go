@@ -0,0 +1,261 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bytes transferred by the download and upload checks, enough to exercise
+// the commands without loading the server
+const checkTransferSize = 100 * 1000
+
+// Outcome of checking one capability of a server
+type Check struct {
+	Name   string  `json:"name"`
+	Pass   bool    `json:"pass"`
+	Detail string  `json:"detail,omitempty"`
+	Time   float64 `json:"time"` // Time taken in ms
+}
+
+// Results of the check subcommand against a server
+type ServerCheck struct {
+	Server *Server `json:"server"`
+	Checks []Check `json:"checks"`
+}
+
+// Number of checks that did not pass
+func (c *ServerCheck) Failed() int {
+	failed := 0
+	for _, check := range c.Checks {
+		if !check.Pass {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Runs a check, timing it and recording its outcome. Once a check fails,
+// the ones that depend on it are recorded as skipped.
+func (c *ServerCheck) run(name string, fn func() (string, error)) bool {
+	start := time.Now()
+	detail, err := fn()
+	check := Check{Name: name, Pass: err == nil, Detail: detail, Time: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		check.Detail = err.Error()
+	}
+	c.Checks = append(c.Checks, check)
+	return check.Pass
+}
+
+func (c *ServerCheck) skip(name, reason string) {
+	c.Checks = append(c.Checks, Check{Name: name, Detail: "skipped, " + reason})
+}
+
+// Dials the server and greets it, returning the connection and the greeting
+func (s *Server) greet() (net.Conn, string, error) {
+	conn, err := s.speedtest.DialHappyEyeballs(s.Host)
+	if err != nil {
+		return nil, "", err
+	}
+	s.tcpAddr = conn.RemoteAddr().(*net.TCPAddr)
+	conn.SetDeadline(time.Now().Add(s.speedtest.Timeout))
+	conn.Write([]byte("HI\n"))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	hello := strings.TrimSpace(string(buf[:n]))
+	if !strings.HasPrefix(hello, "HELLO") {
+		conn.Close()
+		return nil, "", fmt.Errorf("unexpected greeting %q", hello)
+	}
+	return conn, hello, nil
+}
+
+// Checks the socket handshake, latency and a small download and upload
+// against the server, each on a fresh connection so one failing does not
+// affect the others
+func (s *Server) Check() *ServerCheck {
+	c := &ServerCheck{Server: s}
+
+	var conn net.Conn
+	ok := c.run("handshake", func() (string, error) {
+		var hello string
+		var err error
+		conn, hello, err = s.greet()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s from %s", hello, s.tcpAddr), nil
+	})
+	if !ok {
+		for _, name := range []string{"latency", "download", "upload"} {
+			c.skip(name, "handshake failed")
+		}
+		return c
+	}
+
+	c.run("latency", func() (string, error) {
+		defer conn.Close()
+		samples := make([]time.Duration, 0, s.speedtest.CliFlags.PingCount)
+		resp := make([]byte, 1024)
+		for i := 0; i < s.speedtest.CliFlags.PingCount; i++ {
+			start := time.Now()
+			conn.Write([]byte(fmt.Sprintf("PING %d\n", start.UnixNano()/1000000)))
+			n, err := conn.Read(resp)
+			if err != nil {
+				return "", err
+			}
+			if !strings.HasPrefix(string(resp[:n]), "PONG") {
+				return "", fmt.Errorf("unexpected PING response %q", strings.TrimSpace(string(resp[:n])))
+			}
+			samples = append(samples, time.Since(start))
+		}
+		s.setLatency(samples, "tcp")
+		return fmt.Sprintf("%.02f ms", float64(s.Latency)/float64(time.Millisecond)), nil
+	})
+
+	c.run("download", func() (string, error) {
+		conn, _, err := s.greet()
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		start := time.Now()
+		conn.Write([]byte("DOWNLOAD " + strconv.Itoa(checkTransferSize) + "\n"))
+		if _, err := io.ReadFull(conn, make([]byte, checkTransferSize)); err != nil {
+			return "", err
+		}
+		return checkRate(checkTransferSize, time.Since(start)), nil
+	})
+
+	c.run("upload", func() (string, error) {
+		conn, _, err := s.greet()
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		start := time.Now()
+		header := "UPLOAD " + strconv.Itoa(checkTransferSize) + " 0\n"
+		conn.Write([]byte(header))
+		if _, err := conn.Write(uploadPayload()[:checkTransferSize-len(header)]); err != nil {
+			return "", err
+		}
+		resp := make([]byte, 1024)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(string(resp[:n]), "OK") {
+			return "", fmt.Errorf("unexpected UPLOAD response %q", strings.TrimSpace(string(resp[:n])))
+		}
+		return checkRate(checkTransferSize, time.Since(start)), nil
+	})
+	return c
+}
+
+// Describes a check transfer of n bytes taking elapsed
+func checkRate(n int, elapsed time.Duration) string {
+	return fmt.Sprintf("%s at %s", formatBytes(int64(n)), RateUnit(AutoRate).Format(float64(n)*8/elapsed.Seconds()))
+}
+
+func checkUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, `usage: %s check --server ID | --host HOST:PORT [options]
+
+Check that a server completes the socket handshake, answers latency
+requests, and serves a small download and upload, before relying on it
+for long-term monitoring. Exits with a non-zero status when any check fails.
+
+options:
+`, path.Base(os.Args[0]))
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+}
+
+// Entry point of the check subcommand
+func check(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = checkUsage(fs)
+	speedtest := NewSpeedtest()
+	serverID := fs.Int("server", 0, "ID of the server to check, looked up in the speedtest.net server list")
+	host := fs.String("host", "", "`HOST:PORT` of the server to check, such as a Speedtest Mini on the local network")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout of each check")
+	fs.IntVar(&speedtest.CliFlags.PingCount, "ping-count", 3, "Number of latency samples to take")
+	jsonOutput := fs.Bool("json", false, "Output the checks as JSON")
+	fs.Parse(args)
+
+	if (*serverID == 0) == (*host == "") || fs.NArg() > 0 {
+		fs.Usage()
+	}
+	if *timeout <= 0 || speedtest.CliFlags.PingCount < 1 {
+		errorf("--timeout and --ping-count must be positive")
+	}
+	speedtest.Timeout = *timeout
+	speedtest.ConnectTimeout = *timeout
+	speedtest.IOTimeout = *timeout
+
+	server := &Server{Host: *host, speedtest: speedtest}
+	if *serverID != 0 {
+		servers, err := speedtest.GetServers(*serverID)
+		if err != nil {
+			errorf(err.Error())
+		}
+		if len(servers.Servers) == 0 {
+			errorf("Server %d is not in the speedtest.net server list", *serverID)
+		}
+		server = &servers.Servers[0]
+	}
+
+	if !*jsonOutput {
+		if server.ID != 0 {
+			fmt.Printf("Checking server %d %s (%s) at %s\n", server.ID, server.Sponsor, server.Name, server.Host)
+		} else {
+			fmt.Printf("Checking %s\n", server.Host)
+		}
+	}
+	result := server.Check()
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+	} else {
+		for _, c := range result.Checks {
+			status := "pass"
+			if !c.Pass {
+				status = "FAIL"
+			}
+			fmt.Printf("%-10s %s %9.02f ms  %s\n", c.Name, status, c.Time, c.Detail)
+		}
+	}
+	if failed := result.Failed(); failed > 0 {
+		errorf("%d of %d checks failed", failed, len(result.Checks))
+	}
+}
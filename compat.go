@@ -0,0 +1,126 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Result formats of other speedtest clients that can be emitted for
+// compatibility with existing parsers
+var compatModes = map[string]bool{
+	"python": true,
+}
+
+// Results in the JSON format of sivel/speedtest-cli
+type pythonResults struct {
+	Download      float64       `json:"download"`
+	Upload        float64       `json:"upload"`
+	Ping          float64       `json:"ping"`
+	Server        *pythonServer `json:"server"`
+	Timestamp     string        `json:"timestamp"`
+	BytesSent     int64         `json:"bytes_sent"`
+	BytesReceived int64         `json:"bytes_received"`
+	Share         *string       `json:"share"`
+	Client        *pythonClient `json:"client"`
+}
+
+type pythonServer struct {
+	URL     string  `json:"url"`
+	Lat     string  `json:"lat"`
+	Lon     string  `json:"lon"`
+	Name    string  `json:"name"`
+	Country string  `json:"country"`
+	CC      string  `json:"cc"`
+	Sponsor string  `json:"sponsor"`
+	ID      string  `json:"id"`
+	Host    string  `json:"host"`
+	D       float64 `json:"d"`
+	Latency float64 `json:"latency"`
+}
+
+type pythonClient struct {
+	IP        string `json:"ip"`
+	Lat       string `json:"lat"`
+	Lon       string `json:"lon"`
+	ISP       string `json:"isp"`
+	ISPRating string `json:"isprating"`
+	Rating    string `json:"rating"`
+	ISPDLAvg  string `json:"ispdlavg"`
+	ISPULAvg  string `json:"ispulavg"`
+	LoggedIn  string `json:"loggedin"`
+	Country   string `json:"country"`
+}
+
+func formatCoordinate(c float64) string {
+	return strconv.FormatFloat(c, 'f', -1, 64)
+}
+
+// Results converted to the JSON format of sivel/speedtest-cli, which reports
+// the server and client as strings and the timestamp in UTC with microseconds
+func (r *Results) pythonCompat() *pythonResults {
+	p := &pythonResults{
+		Download:      r.Download,
+		Upload:        r.Upload,
+		Ping:          r.Latency,
+		Timestamp:     r.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		BytesSent:     r.BytesSent,
+		BytesReceived: r.BytesReceived,
+	}
+	if r.Share != "" {
+		share := r.Share
+		p.Share = &share
+	}
+	if s := r.Server; s != nil {
+		p.Server = &pythonServer{
+			URL:     s.URL,
+			Lat:     formatCoordinate(s.Latitude),
+			Lon:     formatCoordinate(s.Longitude),
+			Name:    s.Name,
+			Country: s.Country,
+			CC:      s.CC,
+			Sponsor: s.Sponsor,
+			ID:      strconv.Itoa(s.ID),
+			Host:    s.Host,
+			D:       s.Distance,
+			Latency: float64(s.Latency) / float64(time.Millisecond),
+		}
+	}
+	if c := r.Client; c != nil {
+		p.Client = &pythonClient{
+			IP:        c.IP,
+			Lat:       formatCoordinate(c.Latitude),
+			Lon:       formatCoordinate(c.Longitude),
+			ISP:       c.ISP,
+			ISPRating: c.ISPRating,
+			Rating:    c.Rating,
+			ISPDLAvg:  c.ISPDLAvg,
+			ISPULAvg:  c.ISPULAvg,
+			LoggedIn:  c.LoggedIn,
+			Country:   c.Country,
+		}
+	}
+	return p
+}
+
+func validateCompat(mode string) error {
+	if mode != "" && !compatModes[mode] {
+		return fmt.Errorf("Invalid compatibility mode %s, must be python", mode)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Subcommands completed as the first argument
+var subcommands = []string{"run", "list", "history", "export", "verify", "usage", "check", "serve", "collector", "agent", "service", "completion"}
+
+// Flags taking server IDs, completed from the cached server list
+var serverIDFlags = map[string]bool{"server": true, "exclude": true, "pool": true}
+
+// Fixed values of flags, completed as they are
+func completionValues() map[string][]string {
+	var selectors []string
+	for name := range serverSelectors {
+		selectors = append(selectors, name)
+	}
+	sort.Strings(selectors)
+	return map[string][]string{
+		"format":         outputFormatNames,
+		"select":         selectors,
+		"units-speed":    {string(AutoRate), string(Kbits), string(Mbits), string(Gbits)},
+		"units-distance": {string(Kilometers), string(Miles)},
+		"compat":         {"python"},
+		"profile":        {"multi-gig", "lan"},
+		"progress":       {"json"},
+		"schema":         {"v1", fmt.Sprintf("v%d", schemaVersion)},
+	}
+}
+
+// A flag and how to complete its value
+type completionFlag struct {
+	name   string
+	usage  string
+	bool   bool     // Takes no value
+	file   bool     // Takes a file name
+	server bool     // Takes server IDs
+	values []string // Takes one of these values
+}
+
+func completionFlags() []completionFlag {
+	values := completionValues()
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+		c := completionFlag{
+			name:   f.Name,
+			usage:  strings.SplitN(usage, ". ", 2)[0],
+			file:   strings.HasSuffix(name, "FILE") || strings.HasSuffix(name, "PATH"),
+			server: serverIDFlags[f.Name],
+			values: values[f.Name],
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			c.bool = true
+		}
+		flags = append(flags, c)
+	})
+	return flags
+}
+
+func completionUsage() {
+	fmt.Fprintf(os.Stderr, `usage: %[1]s completion bash|zsh|fish|powershell
+
+Print a shell completion script, for example:
+
+  source <(%[1]s completion bash)
+  %[1]s completion zsh > "${fpath[1]}/_%[1]s"
+  %[1]s completion fish > ~/.config/fish/completions/%[1]s.fish
+  %[1]s completion powershell | Out-String | Invoke-Expression
+
+Server IDs are completed from the server list saved by the last test run.
+`, path.Base(os.Args[0]))
+	os.Exit(2)
+}
+
+// Prints a completion script for a shell, or the cached server IDs for use
+// by those scripts
+func completion(args []string) {
+	if len(args) != 1 {
+		completionUsage()
+	}
+	name := path.Base(os.Args[0])
+	switch args[0] {
+	case "bash":
+		bashCompletion(os.Stdout, name, completionFlags())
+	case "zsh":
+		zshCompletion(os.Stdout, name, completionFlags())
+	case "fish":
+		fishCompletion(os.Stdout, name, completionFlags())
+	case "powershell":
+		powershellCompletion(os.Stdout, name, completionFlags())
+	case "servers":
+		// Completion must stay quiet when nothing has been cached yet
+		servers, err := loadServerCache()
+		if err != nil {
+			return
+		}
+		sort.Slice(servers.Servers, func(i, j int) bool {
+			return servers.Servers[i].ID < servers.Servers[j].ID
+		})
+		for _, server := range servers.Servers {
+			fmt.Printf("%d\t%s (%s, %s)\n", server.ID, server.Sponsor, server.Name, server.Country)
+		}
+	default:
+		completionUsage()
+	}
+}
+
+func bashCompletion(w io.Writer, name string, flags []completionFlag) {
+	fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	var names []string
+	fmt.Fprintf(w, "# bash completion for %s\n%s() {\n", name, fn)
+	fmt.Fprintf(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(w, "    case \"$prev\" in\n")
+	for _, f := range flags {
+		names = append(names, "--"+f.name)
+		switch {
+		case f.server:
+			fmt.Fprintf(w, "    --%[1]s|-%[1]s)\n        COMPREPLY=($(compgen -W \"$(%s completion servers 2>/dev/null | cut -f1)\" -- \"$cur\"))\n        return;;\n", f.name, name)
+		case f.values != nil:
+			fmt.Fprintf(w, "    --%[1]s|-%[1]s)\n        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n        return;;\n", f.name, strings.Join(f.values, " "))
+		case f.file:
+			fmt.Fprintf(w, "    --%[1]s|-%[1]s)\n        COMPREPLY=($(compgen -f -- \"$cur\"))\n        return;;\n", f.name)
+		case !f.bool:
+			fmt.Fprintf(w, "    --%[1]s|-%[1]s)\n        return;;\n", f.name)
+		}
+	}
+	fmt.Fprintf(w, "    esac\n")
+	fmt.Fprintf(w, "    if [[ $COMP_CWORD -eq 1 && \"$cur\" != -* ]]; then\n        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(subcommands, " "))
+	fmt.Fprintf(w, "    elif [[ \"$cur\" == -* ]]; then\n        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n    fi\n}\n", strings.Join(names, " "))
+	fmt.Fprintf(w, "complete -F %s %s\n", fn, name)
+}
+
+func zshCompletion(w io.Writer, name string, flags []completionFlag) {
+	escape := strings.NewReplacer(`\`, `\\`, `'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+	fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	fmt.Fprintf(w, "#compdef %s\n\n", name)
+	fmt.Fprintf(w, "%s_servers() {\n    local -a servers\n    local id desc\n", fn)
+	fmt.Fprintf(w, "    %s completion servers 2>/dev/null | while IFS=$'\\t' read -r id desc; do\n        servers+=(\"$id:${desc//:/\\\\:}\")\n    done\n", name)
+	fmt.Fprintf(w, "    _describe 'server' servers\n}\n\n")
+	fmt.Fprintf(w, "_arguments \\\n")
+	for _, f := range flags {
+		spec := fmt.Sprintf("--%s[%s]", f.name, escape.Replace(f.usage))
+		switch {
+		case f.server:
+			spec += ":server:" + fn + "_servers"
+		case f.values != nil:
+			spec += fmt.Sprintf(":%s:(%s)", f.name, strings.Join(f.values, " "))
+		case f.file:
+			spec += ":file:_files"
+		case !f.bool:
+			spec += ":" + f.name + ": "
+		}
+		fmt.Fprintf(w, "    '%s' \\\n", spec)
+	}
+	fmt.Fprintf(w, "    '1::command:(%s)'\n", strings.Join(subcommands, " "))
+}
+
+func fishCompletion(w io.Writer, name string, flags []completionFlag) {
+	quote := func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+	}
+	fmt.Fprintf(w, "# fish completion for %s\ncomplete -c %s -f\n", name, name)
+	fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a %s\n", name, quote(strings.Join(subcommands, " ")))
+	for _, f := range flags {
+		line := fmt.Sprintf("complete -c %s -l %s -d %s", name, f.name, quote(f.usage))
+		switch {
+		case f.server:
+			line += fmt.Sprintf(" -x -a '(%s completion servers 2>/dev/null)'", name)
+		case f.values != nil:
+			line += " -x -a " + quote(strings.Join(f.values, " "))
+		case f.file:
+			line += " -r -F"
+		case !f.bool:
+			line += " -x"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+func powershellCompletion(w io.Writer, name string, flags []completionFlag) {
+	quote := func(s string) string {
+		return "'" + strings.Replace(s, "'", "''", -1) + "'"
+	}
+	list := func(values []string) string {
+		var quoted []string
+		for _, v := range values {
+			quoted = append(quoted, quote(v))
+		}
+		return "@(" + strings.Join(quoted, ", ") + ")"
+	}
+	var names, servers, files []string
+	var valueFlags []completionFlag
+	for _, f := range flags {
+		names = append(names, "--"+f.name)
+		switch {
+		case f.server:
+			servers = append(servers, "--"+f.name, "-"+f.name)
+		case f.values != nil:
+			valueFlags = append(valueFlags, f)
+		case f.file:
+			files = append(files, "--"+f.name, "-"+f.name)
+		}
+	}
+	fmt.Fprintf(w, "# PowerShell completion for %s\n", name)
+	fmt.Fprintf(w, "Register-ArgumentCompleter -Native -CommandName %s -ScriptBlock {\n", quote(name))
+	fmt.Fprintf(w, "    param($wordToComplete, $commandAst, $cursorPosition)\n")
+	fmt.Fprintf(w, "    $words = @($commandAst.CommandElements | Where-Object { $_.Extent.EndOffset -lt $cursorPosition } | ForEach-Object { $_.ToString() })\n")
+	fmt.Fprintf(w, "    $prev = $words[-1]\n")
+	fmt.Fprintf(w, "    $candidates = $null\n")
+	fmt.Fprintf(w, "    if ($prev -in %s) {\n", list(servers))
+	fmt.Fprintf(w, "        $candidates = & %s completion servers | ForEach-Object { ($_ -split \"`t\")[0] }\n", quote(name))
+	fmt.Fprintf(w, "    } elseif ($prev -in %s) {\n        return\n", list(files))
+	fmt.Fprintf(w, "    } else {\n        switch ($prev.TrimStart('-')) {\n")
+	for _, f := range valueFlags {
+		fmt.Fprintf(w, "            %s { $candidates = %s }\n", quote(f.name), list(f.values))
+	}
+	fmt.Fprintf(w, "        }\n    }\n")
+	fmt.Fprintf(w, "    if ($null -eq $candidates) {\n")
+	fmt.Fprintf(w, "        if ($wordToComplete -like '-*') {\n            $candidates = %s\n", list(names))
+	fmt.Fprintf(w, "        } elseif ($words.Count -eq 1) {\n            $candidates = %s\n        }\n    }\n", list(subcommands))
+	fmt.Fprintf(w, "    $candidates | Where-Object { $_ -like \"$wordToComplete*\" } | ForEach-Object {\n")
+	fmt.Fprintf(w, "        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)\n    }\n}\n")
+}
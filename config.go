@@ -0,0 +1,132 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// time.Duration that is read from JSON as a string such as "30m"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("durations must be strings such as \"30m\"")
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Environment variable overriding the path of the default configuration file
+const configEnv = "SPEEDTEST_CONFIG"
+
+// Settings read from the --config file, or speedtest/config.json in the user
+// configuration directory. Every test run applies the blacklist, plan and
+// monthly budget, while the schedule settings are used by serve and
+// collector mode, which reload the file on SIGHUP.
+type Config struct {
+	Blacklist     []int    `json:"blacklist"`      // Server IDs never selected by test runs
+	Plan          Plan     `json:"plan"`           // Advertised speeds of the internet plan
+	MonthlyBudget ByteSize `json:"monthly_budget"` // Data test runs may use each calendar month, 0 for no limit
+
+	Interval      Duration `json:"interval"`       // Time between scheduled test runs
+	Server        int      `json:"server"`         // Server ID to pin test runs to
+	Args          []string `json:"args"`           // Options passed to each test run
+	Pool          []int    `json:"pool"`           // Preferred server IDs, rotated between runs by serve mode
+	Blackout      []string `json:"blackout"`       // Daily windows such as 09:00-17:00 without scheduled runs
+	BlackoutQuick bool     `json:"blackout_quick"` // Run quick tests during blackout windows rather than none
+}
+
+// Reads a JSON configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if config.Interval.Duration < 0 {
+		return nil, errors.New("interval must not be negative")
+	}
+	if _, err := parseBlackout(config.Blackout); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Path of the default configuration file, $SPEEDTEST_CONFIG when set
+func defaultConfigPath() (string, error) {
+	if path := os.Getenv(configEnv); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "speedtest", "config.json"), nil
+}
+
+// Reads the default configuration file, which is optional. Returns an empty
+// configuration when it does not exist.
+func LoadDefaultConfig() (*Config, error) {
+	path, err := defaultConfigPath()
+	if err != nil {
+		return &Config{}, nil
+	}
+	config, err := LoadConfig(path)
+	if os.IsNotExist(err) {
+		return &Config{}, nil
+	}
+	return config, err
+}
+
+// Options for test runs, those given on the command line followed by those
+// from the configuration, which take precedence as later flags win
+func (c *Config) TestArgs(base []string) []string {
+	args := append([]string{}, base...)
+	if c.Server != 0 {
+		args = append(args, "--server", strconv.Itoa(c.Server))
+	}
+	if len(c.Blacklist) > 0 {
+		var ids []string
+		for _, id := range c.Blacklist {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		args = append(args, "--exclude", strings.Join(ids, ","))
+	}
+	return append(args, c.Args...)
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Test connections to a server, kept open from one test to the next so that
+// the download and upload tests do not each dial their own
+type connPool struct {
+	lock        sync.Mutex
+	conns       []net.Conn
+	retransmits []uint32 // Retransmits of each connection at the end of its previous test
+}
+
+// Creates the pool before the first test starts its workers
+func (s *Server) initPool() {
+	if s.pool == nil {
+		s.pool = &connPool{}
+	}
+}
+
+func (p *connPool) grow(worker int) {
+	for len(p.conns) <= worker {
+		p.conns = append(p.conns, nil)
+		p.retransmits = append(p.retransmits, 0)
+	}
+}
+
+// Connection for a worker, reusing the one left by the previous test when
+// there is one, otherwise dialing and greeting the server
+func (s *Server) workerConn(worker int, buf []byte) (net.Conn, error) {
+	s.pool.lock.Lock()
+	s.pool.grow(worker)
+	conn := s.pool.conns[worker]
+	s.pool.conns[worker] = nil
+	if conn == nil {
+		s.pool.retransmits[worker] = 0
+	}
+	s.pool.lock.Unlock()
+
+	if conn != nil {
+		// Clear the deadline left by the previous test
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	// A server that accepts connections but never greets would otherwise
+	// stall the worker before the test even starts
+	if s.speedtest.IOTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.speedtest.IOTimeout))
+	}
+	conn.Write([]byte("HI\n"))
+	if _, err := conn.Read(buf); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Keeps a worker's connection for the next test, or closes it when it is
+// not in a state to be reused
+func (s *Server) releaseConn(worker int, conn net.Conn, reusable bool) {
+	if !reusable {
+		s.speedtest.Debugf("Closing connection %d, it cannot be reused", worker)
+		conn.Close()
+		return
+	}
+	s.pool.lock.Lock()
+	defer s.pool.lock.Unlock()
+	s.pool.conns[worker] = conn
+}
+
+// Closes all connections kept for reuse
+func (s *Server) CloseConns() {
+	if s.pool == nil {
+		return
+	}
+	s.pool.lock.Lock()
+	defer s.pool.lock.Unlock()
+	for i, conn := range s.pool.conns {
+		if conn != nil {
+			conn.Close()
+			s.pool.conns[i] = nil
+		}
+	}
+}
+
+// TCP statistics of a worker's connection for the test that just ended,
+// excluding retransmits from earlier tests on the same connection
+func (s *Server) connStats(worker int, conn net.Conn) *TCPStats {
+	stats := s.speedtest.tcpStats(conn)
+	if stats == nil {
+		return nil
+	}
+	s.pool.lock.Lock()
+	defer s.pool.lock.Unlock()
+	total := stats.Retransmits
+	stats.Retransmits -= s.pool.retransmits[worker]
+	s.pool.retransmits[worker] = total
+	return stats
+}
+
+// Reads the rest of a DOWNLOAD response interrupted by the end of a test, so
+// that the connection can be reused. Returns false when that takes longer
+// than drainTimeout.
+func drainDownload(conn net.Conn, pending int, buf []byte) bool {
+	if pending <= 0 {
+		return true
+	}
+	conn.SetReadDeadline(time.Now().Add(drainTimeout))
+	for pending > 0 {
+		n, err := conn.Read(buf)
+		pending -= n
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads the response to an UPLOAD request interrupted by the end of a test,
+// so that the connection can be reused. Returns false when that takes longer
+// than drainTimeout.
+func drainUpload(conn net.Conn, buf []byte) bool {
+	conn.SetReadDeadline(time.Now().Add(drainTimeout))
+	_, err := conn.Read(buf)
+	return err == nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Time allowed for in-flight requests to complete when a daemon is stopped
+const shutdownTimeout = 5 * time.Second
+
+// Closed by stopDaemon to stop the daemon, such as when the Windows service
+// is stopped
+var (
+	daemonStop     = make(chan struct{})
+	daemonStopOnce sync.Once
+)
+
+// Stops the daemon cleanly, it is safe to call more than once
+func stopDaemon() {
+	daemonStopOnce.Do(func() {
+		close(daemonStop)
+	})
+}
+
+// Parses --until, either a time of day such as 23:00, which is its next
+// occurrence after now, or an RFC 3339 timestamp
+func parseUntil(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	clock, err := time.ParseInLocation("15:04", value, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %s, must be a time of day such as 23:00 or an RFC 3339 timestamp", value)
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// Daily windows of local time, such as 09:00-17:00, during which scheduled
+// test runs are skipped or shortened. A window ending before it starts spans
+// midnight.
+type Blackout []blackoutWindow
+
+// Start and end of a blackout window, in minutes since midnight
+type blackoutWindow struct {
+	start, end int
+}
+
+func (b *Blackout) String() string {
+	var windows []string
+	for _, w := range *b {
+		windows = append(windows, fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60))
+	}
+	return strings.Join(windows, ",")
+}
+
+// Adds comma separated windows, so the flag can also be repeated
+func (b *Blackout) Set(value string) error {
+	for _, window := range strings.Split(value, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(window), "-", 2)
+		if len(bounds) != 2 {
+			return fmt.Errorf("invalid blackout window %s, must be a range of times of day such as 09:00-17:00", window)
+		}
+		var w blackoutWindow
+		for i, bound := range bounds {
+			clock, err := time.Parse("15:04", strings.TrimSpace(bound))
+			if err != nil {
+				return fmt.Errorf("invalid blackout window %s, must be a range of times of day such as 09:00-17:00", window)
+			}
+			minutes := clock.Hour()*60 + clock.Minute()
+			if i == 0 {
+				w.start = minutes
+			} else {
+				w.end = minutes
+			}
+		}
+		*b = append(*b, w)
+	}
+	return nil
+}
+
+// Parses blackout windows from a configuration file or schedule
+func parseBlackout(values []string) (Blackout, error) {
+	var b Blackout
+	for _, value := range values {
+		if err := b.Set(value); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Whether t, in its location, falls within a blackout window
+func (b Blackout) Contains(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	for _, w := range b {
+		if w.start <= w.end && minutes >= w.start && minutes < w.end {
+			return true
+		}
+		if w.start > w.end && (minutes >= w.start || minutes < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends a state notification, such as READY=1, to systemd when running as a
+// Type=notify service
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Interval within which the systemd watchdog expects a keepalive, 0 when the
+// watchdog is not enabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Sends systemd watchdog keepalives at half the watchdog interval until stop
+// is closed
+func sdWatchdog(stop chan struct{}) {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sdNotify("WATCHDOG=1")
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Runs a daemon until run fails, or SIGINT or SIGTERM is received in which
+// case shutdown is called to stop it cleanly. On SIGHUP reload, when not nil,
+// is called to reload the configuration. Readiness, watchdog keepalives,
+// reloading and stopping are reported to systemd.
+func runDaemon(run func() error, shutdown func(), reload func() error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	hangups := make(chan os.Signal, 1)
+	if reload != nil {
+		signal.Notify(hangups, syscall.SIGHUP)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- run()
+	}()
+
+	sdNotify("READY=1")
+	stop := make(chan struct{})
+	go sdWatchdog(stop)
+	defer close(stop)
+
+	for {
+		select {
+		case err := <-errs:
+			errorf(err.Error())
+		case <-hangups:
+			sdNotify("RELOADING=1")
+			if err := reload(); err != nil {
+				fmt.Printf("Could not reload configuration: %s\n", err)
+			} else {
+				fmt.Printf("Reloaded configuration\n")
+			}
+			sdNotify("READY=1")
+		case <-signals:
+			sdNotify("STOPPING=1")
+			shutdown()
+			return
+		case <-daemonStop:
+			shutdown()
+			return
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Time between latency samples taken while a duplex test runs
+const loadedPingInterval = 200 * time.Millisecond
+
+// Runs the download and upload tests at the same time for --duplex, sampling
+// latency over a separate connection while they run. Returns the download
+// and upload transfers, and the latency samples.
+func (s *Server) TestDuplex(downloadLength, uploadLength float64) (*Transfer, *Transfer, []time.Duration) {
+	// Workers of both tests would otherwise share the pooled connections
+	// with the same index
+	uploadServer := *s
+	uploadServer.pool = nil
+	defer uploadServer.CloseConns()
+
+	stop := make(chan struct{})
+	samples := make(chan []time.Duration)
+	go s.sampleLatency(loadedPingInterval, stop, samples)
+
+	var download, upload *Transfer
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		download = s.TestDownload(downloadLength)
+	}()
+	go func() {
+		defer wg.Done()
+		upload = uploadServer.TestUpload(uploadLength)
+	}()
+	wg.Wait()
+
+	close(stop)
+	return download, upload, <-samples
+}
+
+// Samples latency with PING requests every interval until stop is closed.
+// Sampling ends early if the connection fails, a PING that times out under
+// load is not a latency sample.
+func (s *Server) sampleLatency(interval time.Duration, stop chan struct{}, out chan []time.Duration) {
+	var samples []time.Duration
+	defer func() {
+		<-stop
+		out <- samples
+	}()
+
+	conn, err := s.dial()
+	if err != nil {
+		s.speedtest.Debugf("Could not connect to sample loaded latency: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1024)
+	conn.SetDeadline(time.Now().Add(s.speedtest.Timeout))
+	conn.Write([]byte("HI\n"))
+	if _, err := conn.Read(buf); err != nil {
+		s.speedtest.Debugf("Could not greet the server to sample loaded latency: %s", err)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			start := time.Now()
+			conn.SetDeadline(start.Add(s.speedtest.Timeout))
+			if _, err := conn.Write([]byte(fmt.Sprintf("PING %d\n", start.UnixNano()/1000000))); err != nil {
+				s.speedtest.Debugf("Loaded latency sampling failed: %s", err)
+				return
+			}
+			if _, err := conn.Read(buf); err != nil {
+				s.speedtest.Debugf("Loaded latency sampling failed: %s", err)
+				return
+			}
+			samples = append(samples, time.Since(start))
+		case <-stop:
+			return
+		}
+	}
+}
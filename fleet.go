@@ -0,0 +1,553 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variable the fleet token is read from when --token is not set,
+// so that it does not have to appear in the process list
+const tokenEnv = "SPEEDTEST_TOKEN"
+
+// Delay before an agent retries registering with an unreachable collector
+const agentRetryDelay = time.Minute
+
+// Sent by an agent when it registers with a collector
+type AgentInfo struct {
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+	Version  string `json:"version"`
+}
+
+// Test schedule handed to agents by a collector
+type Schedule struct {
+	Interval      int      `json:"interval"`                 // Seconds between test runs
+	Args          []string `json:"args"`                     // Options passed to each test run
+	Blackout      []string `json:"blackout,omitempty"`       // Daily windows of the agent's local time without test runs
+	BlackoutQuick bool     `json:"blackout_quick,omitempty"` // Run quick tests during blackout windows rather than none
+}
+
+// Options a collector may pass to test runs on agents, and whether each takes
+// a value. Anything else, such as hooks, plugins, sinks, output files and the
+// lock file, could run commands, write files or send results elsewhere on the
+// agent, and can only be given on the agent's own command line.
+var scheduleFlags = map[string]bool{
+	"adaptive":           false,
+	"anonymize":          false,
+	"candidates":         true,
+	"congestion":         true,
+	"connect-timeout":    true,
+	"download-chunk":     true,
+	"download-sizes":     true,
+	"download-time":      true,
+	"dscp":               true,
+	"duplex":             false,
+	"estimate-only":      false,
+	"exclude":            true,
+	"expect-isp":         true,
+	"fwmark":             true,
+	"interface-counters": false,
+	"io-timeout":         true,
+	"keepalive":          true,
+	"lat":                true,
+	"limit-rate":         true,
+	"lon":                true,
+	"max-bytes":          true,
+	"monthly-budget":     true,
+	"mtu":                false,
+	"nagle":              false,
+	"no-download":        false,
+	"no-upload":          false,
+	"ping-count":         true,
+	"ping-url":           true,
+	"plan-download":      true,
+	"plan-upload":        true,
+	"pool":               true,
+	"profile":            true,
+	"quic-url":           true,
+	"quick":              false,
+	"ramp":               true,
+	"read-buffer":        true,
+	"recv-buffer":        true,
+	"resolve":            true,
+	"route-hops":         true,
+	"secure":             false,
+	"select":             true,
+	"send-buffer":        true,
+	"server":             true,
+	"skip-ip-lookup":     false,
+	"source":             true,
+	"tag":                true,
+	"threads":            true,
+	"timeout":            true,
+	"transport":          true,
+	"units-distance":     true,
+	"units-speed":        true,
+	"upload-chunk":       true,
+	"upload-sizes":       true,
+	"upload-time":        true,
+	"vrf":                true,
+}
+
+// Checks that a schedule only passes options in scheduleFlags to test runs
+func checkScheduleArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' || arg == "--" {
+			return fmt.Errorf("unexpected argument %q", arg)
+		}
+		parts := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)
+		value, ok := scheduleFlags[parts[0]]
+		if !ok {
+			return fmt.Errorf("option %s is not allowed in a schedule", arg)
+		}
+		if value && len(parts) == 1 {
+			i++
+		}
+	}
+	return nil
+}
+
+// Sent by an agent after each test run
+type Report struct {
+	Agent   string   `json:"agent"`
+	Results *Results `json:"results"`
+}
+
+// An agent known to a collector
+type AgentState struct {
+	AgentInfo
+	Registered time.Time `json:"registered"`
+	LastSeen   time.Time `json:"last_seen"`
+	LastResult string    `json:"last_result,omitempty"` // ID of the latest results reported
+}
+
+// Central server that agents register with, receive their schedule from and
+// report results to
+type Collector struct {
+	token    string
+	schedule Schedule
+	history  *History
+
+	lock   sync.Mutex
+	agents map[string]*AgentState
+}
+
+func NewCollector(token string, schedule Schedule, history *History) *Collector {
+	return &Collector{
+		token:    token,
+		schedule: schedule,
+		history:  history,
+		agents:   make(map[string]*AgentState),
+	}
+}
+
+// REST API for the collector, every endpoint requires the fleet token
+func (c *Collector) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/agents/register", c.handleRegister)
+	mux.HandleFunc("/api/agents/results", c.handleResults)
+	mux.HandleFunc("/api/agents", c.handleAgents)
+	mux.HandleFunc("/api/results/latest", c.history.handleLatest)
+	mux.HandleFunc("/api/history", c.history.handleHistory)
+	return c.authenticate(mux)
+}
+
+// Rejects requests without the fleet token as a bearer token
+func (c *Collector) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Replaces the schedule handed to agents, which pick it up when they next
+// register
+func (c *Collector) SetSchedule(schedule Schedule) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.schedule = schedule
+}
+
+func (c *Collector) Schedule() Schedule {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.schedule
+}
+
+// POST /api/agents/register records an agent and returns its schedule
+func (c *Collector) handleRegister(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var info AgentInfo
+	if err := json.NewDecoder(req.Body).Decode(&info); err != nil || info.Name == "" {
+		writeError(w, http.StatusBadRequest, "invalid agent")
+		return
+	}
+
+	c.lock.Lock()
+	now := time.Now()
+	agent, ok := c.agents[info.Name]
+	if !ok {
+		agent = &AgentState{Registered: now}
+		c.agents[info.Name] = agent
+	}
+	agent.AgentInfo = info
+	agent.LastSeen = now
+	c.lock.Unlock()
+
+	writeJSON(w, http.StatusOK, c.Schedule())
+}
+
+// POST /api/agents/results records the results of a test run by an agent
+func (c *Collector) handleResults(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var report Report
+	if err := json.NewDecoder(req.Body).Decode(&report); err != nil || report.Results == nil {
+		writeError(w, http.StatusBadRequest, "invalid report")
+		return
+	}
+
+	c.lock.Lock()
+	agent, ok := c.agents[report.Agent]
+	if ok {
+		agent.LastSeen = time.Now()
+		agent.LastResult = report.Results.ID
+	}
+	c.lock.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown agent "+report.Agent)
+		return
+	}
+
+	// Label results with the agent that reported them
+	if report.Results.Tags == nil {
+		report.Results.Tags = Tags{}
+	}
+	report.Results.Tags["agent"] = report.Agent
+	if err := c.history.Add(report.Results); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/agents lists the registered agents
+func (c *Collector) handleAgents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	c.lock.Lock()
+	agents := make([]AgentState, 0, len(c.agents))
+	for _, agent := range c.agents {
+		agents = append(agents, *agent)
+	}
+	c.lock.Unlock()
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].Name < agents[j].Name
+	})
+	writeJSON(w, http.StatusOK, agents)
+}
+
+// Probe that runs tests on the schedule given by a collector and reports the
+// results back to it
+type Agent struct {
+	info       AgentInfo
+	collector  string
+	token      string
+	args       []string // Test options from the agent's command line
+	runner     *Runner
+	HTTPClient *http.Client
+}
+
+// Makes an authenticated request to the collector, decoding any JSON
+// response into out
+func (a *Agent) call(method, endpoint string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(a.collector, "/")+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %s", res.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Registers with the collector, returning the schedule to follow
+func (a *Agent) Register() (*Schedule, error) {
+	schedule := &Schedule{}
+	if err := a.call("POST", "/api/agents/register", a.info, schedule); err != nil {
+		return nil, err
+	}
+	if schedule.Interval < 1 {
+		return nil, fmt.Errorf("invalid interval %d in schedule", schedule.Interval)
+	}
+	return schedule, nil
+}
+
+// Reports the results of a test run to the collector
+func (a *Agent) Report(results *Results) error {
+	return a.call("POST", "/api/agents/results", Report{Agent: a.info.Name, Results: results}, nil)
+}
+
+// Runs tests on the collector's schedule forever. The schedule is fetched
+// again before every run, so changes on the collector reach agents without
+// restarting them.
+func (a *Agent) Run() {
+	for {
+		schedule, err := a.Register()
+		if err != nil {
+			fmt.Printf("Could not register with collector %s: %s\n", a.collector, err)
+			time.Sleep(agentRetryDelay)
+			continue
+		}
+
+		if err := checkScheduleArgs(schedule.Args); err != nil {
+			fmt.Printf("Ignoring schedule from collector %s: %s\n", a.collector, err)
+			time.Sleep(time.Duration(schedule.Interval) * time.Second)
+			continue
+		}
+		a.runner.Configure(append(append([]string{}, a.args...), schedule.Args...), 0)
+		blackout, err := parseBlackout(schedule.Blackout)
+		if err != nil {
+			fmt.Printf("Ignoring blackout from collector %s: %s\n", a.collector, err)
+		}
+		a.runner.SetBlackout(blackout, schedule.BlackoutQuick)
+		skip, quick := a.runner.blackedOut(time.Now())
+		if skip {
+			fmt.Printf("Skipping test run during blackout %s\n", blackout.String())
+			time.Sleep(time.Duration(schedule.Interval) * time.Second)
+			continue
+		}
+
+		results, err := a.runner.execute(quick)
+		if err != nil {
+			fmt.Printf("Test failed: %s\n", err)
+		} else if err := a.Report(results); err != nil {
+			fmt.Printf("Could not report results to collector %s: %s\n", a.collector, err)
+		}
+
+		time.Sleep(time.Duration(schedule.Interval) * time.Second)
+	}
+}
+
+func fleetUsage(fs *flag.FlagSet, usage string) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, usage, path.Base(os.Args[0]))
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+}
+
+// Entry point of the collector subcommand
+func collector(args []string) {
+	fs := flag.NewFlagSet("collector", flag.ExitOnError)
+	fs.Usage = fleetUsage(fs, `usage: %s collector [options] [-- test options]
+
+Collect results from agents, which run tests on the schedule set here.
+
+options:
+`)
+	listen := fs.String("listen", ":8443", "Address to serve the collector API on")
+	cert := fs.String("cert", "", "PEM encoded TLS certificate `FILE`")
+	key := fs.String("key", "", "PEM encoded TLS private key `FILE`")
+	token := fs.String("token", "", "Token agents must authenticate with (default from $"+tokenEnv+")")
+	interval := fs.Duration("interval", time.Hour, "Time between test runs on each agent")
+	historyPath := fs.String("history", "", "Append results to the JSON lines history `FILE`, history is kept in memory only when not set")
+	historyKey := fs.String("history-key", "", "Encrypt the history with the hex or base64 encoded AES-256 key in `FILE`")
+	historyMigrate := fs.Bool("history-migrate", false, "Encrypt history written before --history-key was set, which is otherwise rejected")
+	configPath := fs.String("config", "", "JSON configuration `FILE` with schedule and test settings, reloaded on SIGHUP")
+	var blackout Blackout
+	fs.Var(&blackout, "blackout", "Daily `WINDOWS` of the agents' local time without test runs, such as 09:00-17:00, comma separated or repeated")
+	blackoutQuick := fs.Bool("blackout-quick", false, "Run quick tests during --blackout windows rather than none")
+	fs.Parse(args)
+
+	if *cert == "" || *key == "" {
+		errorf("--cert and --key are required")
+	}
+	// Read here rather than as the flag default, which usage output prints
+	if *token == "" {
+		*token = os.Getenv(tokenEnv)
+	}
+	if *token == "" {
+		errorf("--token or $%s is required", tokenEnv)
+	}
+	if *interval < time.Second {
+		errorf("Invalid interval %s, must be at least 1s", *interval)
+	}
+
+	history, err := OpenHistory(*historyPath, *historyKey, *historyMigrate)
+	if err != nil {
+		errorf("Could not load history %s: %s", *historyPath, err)
+	}
+	c := NewCollector(*token, Schedule{}, history)
+	configure := func() error {
+		schedule := Schedule{
+			Interval:      int(interval.Seconds()),
+			Args:          append([]string{}, fs.Args()...),
+			BlackoutQuick: *blackoutQuick,
+		}
+		if len(blackout) > 0 {
+			schedule.Blackout = strings.Split(blackout.String(), ",")
+		}
+		if *configPath != "" {
+			config, err := LoadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+			schedule.Args = config.TestArgs(schedule.Args)
+			if config.Interval.Duration >= time.Second {
+				schedule.Interval = int(config.Interval.Seconds())
+			}
+			if len(config.Blackout) > 0 {
+				schedule.Blackout = config.Blackout
+				schedule.BlackoutQuick = config.BlackoutQuick
+			}
+		}
+		if err := checkScheduleArgs(schedule.Args); err != nil {
+			return err
+		}
+		c.SetSchedule(schedule)
+		return nil
+	}
+	if err := configure(); err != nil {
+		errorf("Could not load configuration %s: %s", *configPath, err)
+	}
+
+	server := &http.Server{Addr: *listen, Handler: c.Handler()}
+	fmt.Printf("Serving collector on %s\n", *listen)
+	runDaemon(func() error {
+		return server.ListenAndServeTLS(*cert, *key)
+	}, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, configure)
+}
+
+// Entry point of the agent subcommand
+func agent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	fs.Usage = fleetUsage(fs, `usage: %s agent [options] [-- test options]
+
+Run tests on the schedule set by a collector and report results to it. Test
+options given here, such as hooks, apply to every run, while the collector may
+only set options that affect the test itself.
+
+options:
+`)
+	collectorURL := fs.String("collector", "", "HTTPS `URL` of the collector")
+	token := fs.String("token", "", "Token to authenticate with (default from $"+tokenEnv+")")
+	hostname, _ := os.Hostname()
+	name := fs.String("name", hostname, "Name to register with")
+	caCert := fs.String("cacert", "", "PEM encoded CA bundle used to verify the collector certificate")
+	fs.Parse(args)
+
+	if !strings.HasPrefix(*collectorURL, "https://") {
+		errorf("--collector must be an https:// URL")
+	}
+	// Read here rather than as the flag default, which usage output prints
+	if *token == "" {
+		*token = os.Getenv(tokenEnv)
+	}
+	if *token == "" {
+		errorf("--token or $%s is required", tokenEnv)
+	}
+	if *name == "" {
+		errorf("--name is required")
+	}
+
+	// Results are kept by the collector, not the agent
+	history, _ := OpenHistory("", "", false)
+
+	tlsConfig := &tls.Config{}
+	if *caCert != "" {
+		pem, err := ioutil.ReadFile(*caCert)
+		if err != nil {
+			errorf("Could not read CA bundle %s: %s", *caCert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			errorf("No certificates found in CA bundle %s", *caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	a := &Agent{
+		info: AgentInfo{
+			Name:     *name,
+			Hostname: hostname,
+			Version:  version,
+		},
+		collector: *collectorURL,
+		token:     *token,
+		args:      fs.Args(),
+		runner:    NewRunner(nil, history),
+		HTTPClient: &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	}
+	fmt.Printf("Reporting to collector %s as %s\n", *collectorURL, *name)
+	runDaemon(func() error {
+		a.Run()
+		return nil
+	}, a.runner.Stop, nil)
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Fills in the client coordinates and ISP from local MaxMind databases, a
+// City database for the coordinates and an ASN or ISP database for the ISP
+func (c *Client) LookupGeoIP(paths []string) error {
+	ip := net.ParseIP(c.IP)
+	if ip == nil {
+		return fmt.Errorf("invalid client IP address %q", c.IP)
+	}
+	for _, path := range paths {
+		db, err := geoip2.Open(path)
+		if err != nil {
+			return err
+		}
+		err = c.lookupGeoIP(db, ip)
+		db.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) lookupGeoIP(db *geoip2.Reader, ip net.IP) error {
+	dbType := db.Metadata().DatabaseType
+	switch {
+	case strings.HasSuffix(dbType, "-City"):
+		city, err := db.City(ip)
+		if err != nil {
+			return err
+		}
+		if city.Location.Latitude != 0 || city.Location.Longitude != 0 {
+			c.Latitude = city.Location.Latitude
+			c.Longitude = city.Location.Longitude
+		}
+		if city.Country.IsoCode != "" {
+			c.Country = city.Country.IsoCode
+		}
+	case strings.HasSuffix(dbType, "-ISP"):
+		isp, err := db.ISP(ip)
+		if err != nil {
+			return err
+		}
+		if isp.ISP != "" {
+			c.ISP = isp.ISP
+		}
+	case strings.HasSuffix(dbType, "-ASN"):
+		asn, err := db.ASN(ip)
+		if err != nil {
+			return err
+		}
+		if asn.AutonomousSystemOrganization != "" {
+			c.ISP = asn.AutonomousSystemOrganization
+		}
+	default:
+		return fmt.Errorf("unsupported database type %q, must be a City, ISP or ASN database", dbType)
+	}
+	return nil
+}
+
+// Autonomous system an address is routed to
+type ASNInfo struct {
+	Number       uint   `json:"number" xml:"number,attr"`
+	Organization string `json:"organization" xml:"organization,attr"`
+}
+
+func (a *ASNInfo) String() string {
+	return fmt.Sprintf("AS%d %s", a.Number, a.Organization)
+}
+
+// Looks up the autonomous system of ip in the ASN or ISP databases among
+// paths, others are skipped. Returns nil when ip is not found.
+func lookupASN(paths []string, ip net.IP) (*ASNInfo, error) {
+	for _, path := range paths {
+		db, err := geoip2.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := lookupASNIn(db, ip)
+		db.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if info != nil {
+			return info, nil
+		}
+	}
+	return nil, nil
+}
+
+func lookupASNIn(db *geoip2.Reader, ip net.IP) (*ASNInfo, error) {
+	var info ASNInfo
+	dbType := db.Metadata().DatabaseType
+	switch {
+	case strings.HasSuffix(dbType, "-ISP"):
+		isp, err := db.ISP(ip)
+		if err != nil {
+			return nil, err
+		}
+		info = ASNInfo{isp.AutonomousSystemNumber, isp.AutonomousSystemOrganization}
+	case strings.HasSuffix(dbType, "-ASN"):
+		asn, err := db.ASN(ip)
+		if err != nil {
+			return nil, err
+		}
+		info = ASNInfo{asn.AutonomousSystemNumber, asn.AutonomousSystemOrganization}
+	}
+	if info.Number == 0 {
+		return nil, nil
+	}
+	return &info, nil
+}
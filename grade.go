@@ -0,0 +1,148 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Letter grades indexed by points, from F (0) to A (4)
+var gradeLetters = []string{"F", "D", "C", "B", "A"}
+
+// Upper bounds of each component for grades A to D, anything above is an F
+var (
+	consistencyGrades = []float64{0.1, 0.2, 0.35, 0.5} // Coefficient of variation of throughput samples
+	bufferbloatGrades = []float64{30, 60, 200, 400}    // Increase in latency under load, in ms
+	jitterGrades      = []float64{5, 10, 20, 40}       // Standard deviation of latency, in ms
+	lossGrades        = []float64{0.1, 0.5, 1, 2.5}    // Estimated packet loss, in percent
+)
+
+// TCP payload per segment assumed when the path MTU is unknown
+const defaultMSS = 1448
+
+// Overall A to F grade of the connection, DSLReports style, with the grades
+// of the components it is made of. Components that were not measured are
+// empty and do not count toward the overall grade.
+type Grade struct {
+	Overall     string `json:"overall" xml:"overall"`
+	Consistency string `json:"consistency" xml:"consistency"`
+	Bufferbloat string `json:"bufferbloat,omitempty" xml:"bufferbloat,omitempty"`
+	Jitter      string `json:"jitter,omitempty" xml:"jitter,omitempty"`
+	Loss        string `json:"loss,omitempty" xml:"loss,omitempty"`
+}
+
+func (g *Grade) String() string {
+	var parts []string
+	for _, c := range []struct{ name, grade string }{
+		{"consistency", g.Consistency},
+		{"bufferbloat", g.Bufferbloat},
+		{"jitter", g.Jitter},
+		{"loss", g.Loss},
+	} {
+		if c.grade != "" {
+			parts = append(parts, c.name+" "+c.grade)
+		}
+	}
+	return fmt.Sprintf("%s (%s)", g.Overall, strings.Join(parts, ", "))
+}
+
+// Points from 4 (A) to 0 (F) of a value against the upper bounds of a
+// component
+func gradePoints(value float64, bounds []float64) int {
+	for i, bound := range bounds {
+		if value <= bound {
+			return len(bounds) - i
+		}
+	}
+	return 0
+}
+
+// Coefficient of variation of throughput samples, skipping the first sample
+// which includes TCP slow start
+func variation(samples []float64) (float64, bool) {
+	if len(samples) > 2 {
+		samples = samples[1:]
+	}
+	if len(samples) < 2 {
+		return 0, false
+	}
+	var sum float64
+	for _, sample := range samples {
+		sum += sample
+	}
+	mean := sum / float64(len(samples))
+	if mean == 0 {
+		return 0, false
+	}
+	var squares float64
+	for _, sample := range samples {
+		squares += (sample - mean) * (sample - mean)
+	}
+	return math.Sqrt(squares/float64(len(samples))) / mean, true
+}
+
+// Grades the connection from the consistency of throughput, the increase in
+// latency under load when it was measured with --duplex, latency jitter, and
+// packet loss estimated from upload retransmits when TCP_INFO is available.
+// Returns nil when throughput was not sampled.
+func (r *Results) ComputeGrade() *Grade {
+	grade := &Grade{}
+	total, count := 0, 0
+	add := func(value float64, bounds []float64) string {
+		points := gradePoints(value, bounds)
+		total += points
+		count++
+		return gradeLetters[points]
+	}
+
+	// The less consistent direction decides
+	worst, measured := 0.0, false
+	for _, samples := range [][]float64{r.DownloadSamples, r.UploadSamples} {
+		if cv, ok := variation(samples); ok {
+			worst = math.Max(worst, cv)
+			measured = true
+		}
+	}
+	if !measured {
+		return nil
+	}
+	grade.Consistency = add(worst, consistencyGrades)
+
+	if r.LoadedLatency > 0 {
+		grade.Bufferbloat = add(math.Max(r.LoadedLatency-r.Latency, 0), bufferbloatGrades)
+	}
+	if r.Latency > 0 {
+		grade.Jitter = add(r.LatencyStdDev, jitterGrades)
+	}
+
+	var uploaded int64
+	for _, c := range r.UploadConns {
+		uploaded += c.Bytes
+	}
+	if r.UploadTCP != nil && uploaded > 0 {
+		mss := defaultMSS
+		if r.PathMTU != nil && r.PathMTU.MSS > 0 {
+			mss = r.PathMTU.MSS
+		}
+		segments := float64(uploaded) / float64(mss)
+		grade.Loss = add(float64(r.UploadTCP.Retransmits)/segments*100, lossGrades)
+	}
+
+	grade.Overall = gradeLetters[int(math.Round(float64(total)/float64(count)))]
+	return grade
+}
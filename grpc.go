@@ -0,0 +1,163 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build grpc
+// +build grpc
+
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sivel/speedtest/speedtestpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// gRPC service for serve mode, backed by the same Runner as the REST API
+type grpcServer struct {
+	speedtestpb.UnimplementedSpeedtestServer
+	runner *Runner
+}
+
+// Serves the gRPC API on addr until it fails
+func serveGRPC(addr string, runner *Runner) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer()
+	speedtestpb.RegisterSpeedtestServer(server, &grpcServer{runner: runner})
+	return server.Serve(lis)
+}
+
+func (g *grpcServer) RunTest(req *speedtestpb.RunTestRequest, stream speedtestpb.Speedtest_RunTestServer) error {
+	// Subscribe before starting, so that no events of the run are missed
+	events := g.runner.Subscribe()
+	defer g.runner.Unsubscribe(events)
+	if _, err := g.runner.Start(); err != nil {
+		return status.Error(codes.Aborted, err.Error())
+	}
+
+	for {
+		select {
+		case event := <-events:
+			if err := stream.Send(protoEvent(event)); err != nil {
+				return err
+			}
+			runStatus, ok := event.Data.(RunStatus)
+			if !ok || runStatus.Running {
+				continue
+			}
+			if runStatus.Error != "" {
+				return status.Error(codes.Internal, runStatus.Error)
+			}
+			if latest := g.runner.history.Latest(); latest != nil && latest.ID == runStatus.Result {
+				return stream.Send(&speedtestpb.Event{
+					Event: &speedtestpb.Event_Result{Result: protoResult(latest)},
+				})
+			}
+			return nil
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (g *grpcServer) StreamProgress(req *speedtestpb.StreamProgressRequest, stream speedtestpb.Speedtest_StreamProgressServer) error {
+	events := g.runner.Subscribe()
+	defer g.runner.Unsubscribe(events)
+	if err := stream.Send(protoEvent(Event{Name: "status", Data: g.runner.Status()})); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event := <-events:
+			if err := stream.Send(protoEvent(event)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (g *grpcServer) GetHistory(ctx context.Context, req *speedtestpb.GetHistoryRequest) (*speedtestpb.GetHistoryResponse, error) {
+	if req.GetLimit() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit must not be negative")
+	}
+	resp := &speedtestpb.GetHistoryResponse{}
+	for _, results := range g.runner.history.List(int(req.GetLimit())) {
+		resp.Results = append(resp.Results, protoResult(results))
+	}
+	return resp, nil
+}
+
+func protoEvent(event Event) *speedtestpb.Event {
+	switch data := event.Data.(type) {
+	case ProgressEvent:
+		return &speedtestpb.Event{Event: &speedtestpb.Event_Progress{Progress: &speedtestpb.Progress{
+			Phase:   data.Phase,
+			Elapsed: data.Elapsed,
+			Bytes:   data.Bytes,
+			Rate:    data.Rate,
+		}}}
+	case RunStatus:
+		return &speedtestpb.Event{Event: &speedtestpb.Event_Status{Status: &speedtestpb.RunStatus{
+			Running:  data.Running,
+			Started:  protoTime(data.Started),
+			Finished: protoTime(data.Finished),
+			Error:    data.Error,
+			Result:   data.Result,
+		}}}
+	}
+	return &speedtestpb.Event{}
+}
+
+func protoTime(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func protoResult(r *Results) *speedtestpb.Result {
+	result := &speedtestpb.Result{
+		Id:            r.ID,
+		Timestamp:     timestamppb.New(r.Timestamp),
+		Latency:       r.Latency,
+		Download:      r.Download,
+		Upload:        r.Upload,
+		BytesSent:     r.BytesSent,
+		BytesReceived: r.BytesReceived,
+		Tags:          r.Tags,
+	}
+	if r.Server != nil {
+		result.Server = &speedtestpb.Server{
+			Id:       int32(r.Server.ID),
+			Sponsor:  r.Server.Sponsor,
+			Name:     r.Server.Name,
+			Country:  r.Server.Country,
+			Host:     r.Server.Host,
+			Distance: r.Server.Distance,
+		}
+	}
+	return result
+}
@@ -0,0 +1,355 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Results of past runs, kept in memory and appended to a JSON lines file when
+// a path is given
+type History struct {
+	path    string
+	aead    cipher.AEAD
+	lock    sync.Mutex
+	results []*Results
+}
+
+// Loads the history stored at path, which may not exist yet. An empty path
+// keeps history in memory only. With a keyFile, each line is encrypted with
+// AES-256-GCM, for probes deployed in locations that are not trusted, and
+// plain lines are rejected, as anyone able to write the file could add them.
+// With migrate, plain lines written before the history was encrypted are
+// accepted once, and the whole file is rewritten encrypted.
+func OpenHistory(path, keyFile string, migrate bool) (*History, error) {
+	h := &History{path: path}
+	if keyFile != "" {
+		aead, err := loadHistoryKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		h.aead = aead
+	}
+	if path == "" {
+		return h, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	plain := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		line := scanner.Bytes()
+		if line[0] == '{' {
+			if h.aead != nil && !migrate {
+				return nil, errors.New("history contains lines that are not encrypted, use --history-migrate to encrypt history written before --history-key was set")
+			}
+			plain++
+		} else if line, err = h.decrypt(line); err != nil {
+			return nil, err
+		}
+		results := &Results{}
+		if err := json.Unmarshal(line, results); err != nil {
+			return nil, err
+		}
+		h.results = append(h.results, results)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if h.aead != nil && plain > 0 {
+		return h, h.rewrite()
+	}
+	return h, nil
+}
+
+// Replaces the history file with the results, all encrypted
+func (h *History) rewrite() error {
+	var data []byte
+	for _, results := range h.results {
+		line, err := json.Marshal(results)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, h.encrypt(line)...), '\n')
+	}
+	tmp := h.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// Records the results of a run
+func (h *History) Add(results *Results) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.results = append(h.results, results)
+	if h.path == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	perm := os.FileMode(0644)
+	if h.aead != nil {
+		line = h.encrypt(line)
+		perm = 0600
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Reads a 32 byte AES-256 key, hex or base64 encoded, from path
+func loadHistoryKey(path string) (cipher.AEAD, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	key, err := hex.DecodeString(string(data))
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(string(data))
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("key file %s must contain a hex or base64 encoded 32 byte key", path)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts a line, as base64 of the nonce followed by the sealed line
+func (h *History) encrypt(line []byte) []byte {
+	nonce := make([]byte, h.aead.NonceSize(), h.aead.NonceSize()+len(line)+h.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	sealed := h.aead.Seal(nonce, nonce, line, nil)
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(encoded, sealed)
+	return encoded
+}
+
+// Decrypts a line written by encrypt
+func (h *History) decrypt(line []byte) ([]byte, error) {
+	if h.aead == nil {
+		return nil, errors.New("history is encrypted, a key file is required")
+	}
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, line)
+	if err != nil || n < h.aead.NonceSize() {
+		return nil, errors.New("history line is not valid encrypted data")
+	}
+	nonce, sealed := sealed[:h.aead.NonceSize()], sealed[h.aead.NonceSize():n]
+	plain, err := h.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt history, the key file may be wrong")
+	}
+	return plain, nil
+}
+
+// Results of the most recent run, or nil when there are none
+func (h *History) Latest() *Results {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.results) == 0 {
+		return nil
+	}
+	return h.results[len(h.results)-1]
+}
+
+// Results of up to limit of the most recent runs, oldest first. A limit of 0
+// returns all runs.
+func (h *History) List(limit int) []*Results {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	results := h.results
+	if limit > 0 && len(results) > limit {
+		results = results[len(results)-limit:]
+	}
+	return append([]*Results{}, results...)
+}
+
+// Opens the history file named by the only argument of a subcommand,
+// decrypting it with keyFile when set
+func openHistoryArg(fs *flag.FlagSet, keyFile string) *History {
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+	if _, err := os.Stat(fs.Arg(0)); err != nil {
+		errorf("Could not load history %s: %s", fs.Arg(0), err)
+	}
+	history, err := OpenHistory(fs.Arg(0), keyFile, false)
+	if err != nil {
+		errorf("Could not load history %s: %s", fs.Arg(0), err)
+	}
+	return history
+}
+
+func historyUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, `usage: %s history [options] FILE
+
+Show the results of past runs stored in a JSON lines history file, as written
+by serve --history or collector --history.
+
+options:
+`, path.Base(os.Args[0]))
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+}
+
+// Entry point of the history subcommand
+func history(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	fs.Usage = historyUsage(fs)
+	limit := fs.Int("limit", 0, "Show only the latest N runs, 0 shows all runs")
+	units := fs.String("units-speed", string(AutoRate), "Unit to display speeds in, auto, kbit, mbit or gbit")
+	keyFile := fs.String("history-key", "", "Decrypt the history with the AES-256 key in `FILE`")
+	fs.Parse(args)
+
+	rateUnit, err := parseRateUnit(*units)
+	if err != nil {
+		errorf(err.Error())
+	}
+	h := openHistoryArg(fs, *keyFile)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tSERVER\tLATENCY\tDOWNLOAD\tUPLOAD")
+	for _, results := range h.List(*limit) {
+		server := ""
+		if results.Server != nil {
+			server = fmt.Sprintf("%d %s (%s)", results.Server.ID, results.Server.Sponsor, results.Server.Name)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.02f ms\t%s\t%s\n",
+			results.Timestamp.Local().Format(time.RFC3339), server, results.Latency,
+			rateUnit.Format(results.Download), rateUnit.Format(results.Upload))
+	}
+	tw.Flush()
+}
+
+func exportUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, `usage: %s export [options] FILE
+
+Convert the results of past runs stored in a JSON lines history file, as
+written by serve --history or collector --history, to another format.
+
+options:
+`, path.Base(os.Args[0]))
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+}
+
+// Entry point of the export subcommand
+func export(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = exportUsage(fs)
+	format := fs.String("format", "csv", "Format to export to, json for a JSON array, jsonl, csv or influx")
+	limit := fs.Int("limit", 0, "Export only the latest N runs, 0 exports all runs")
+	since := fs.Duration("since", 0, "Export only runs within this long ago, such as 168h")
+	output := fs.String("output", "", "Write to `FILE` instead of stdout")
+	keyFile := fs.String("history-key", "", "Decrypt the history with the AES-256 key in `FILE`")
+	csvExtended := fs.Bool("csv-extended", false, "Add data used, tags and plan percentage columns to CSV output")
+	fs.Parse(args)
+
+	// Formats that cannot be concatenated are not offered
+	var write func(*Results, io.Writer) error
+	switch *format {
+	case "json":
+	case "jsonl", "csv", "influx":
+		write = outputFormats[*format]
+	default:
+		errorf("Invalid export format %s, must be json, jsonl, csv or influx", *format)
+	}
+	h := openHistoryArg(fs, *keyFile)
+
+	var results []*Results
+	for _, r := range h.List(*limit) {
+		r.csvExtended = *csvExtended
+		if *since == 0 || time.Since(r.Timestamp) <= *since {
+			results = append(results, r)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			errorf("Could not create %s: %s", *output, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if write == nil {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+		if results == nil {
+			results = []*Results{}
+		}
+		if err := encoder.Encode(results); err != nil {
+			errorf("Could not export results: %s", err)
+		}
+		return
+	}
+	for _, r := range results {
+		if err := write(r, w); err != nil {
+			errorf("Could not export results: %s", err)
+		}
+	}
+}
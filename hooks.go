@@ -0,0 +1,82 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+)
+
+// Environment exposing the results to hook commands
+func (r *Results) Environ() []string {
+	env := []string{
+		"SPEEDTEST_ID=" + r.ID,
+		"SPEEDTEST_TIMESTAMP=" + r.Timestamp.Format("2006-01-02T15:04:05Z07:00"),
+		"SPEEDTEST_DOWNLOAD_BPS=" + strconv.FormatFloat(r.Download, 'f', 0, 64),
+		"SPEEDTEST_UPLOAD_BPS=" + strconv.FormatFloat(r.Upload, 'f', 0, 64),
+		"SPEEDTEST_LATENCY_MS=" + strconv.FormatFloat(r.Latency, 'f', 3, 64),
+		"SPEEDTEST_BYTES_SENT=" + strconv.FormatInt(r.BytesSent, 10),
+		"SPEEDTEST_BYTES_RECEIVED=" + strconv.FormatInt(r.BytesReceived, 10),
+		"SPEEDTEST_SHARE=" + r.Share,
+		"SPEEDTEST_VPN=" + strconv.FormatBool(r.VPN),
+		"SPEEDTEST_PUBLIC_IPV4=" + r.PublicIPv4,
+		"SPEEDTEST_PUBLIC_IPV6=" + r.PublicIPv6,
+	}
+	if r.Server != nil {
+		env = append(env,
+			"SPEEDTEST_SERVER_ID="+strconv.Itoa(r.Server.ID),
+			"SPEEDTEST_SERVER_SPONSOR="+r.Server.Sponsor,
+			"SPEEDTEST_SERVER_NAME="+r.Server.Name,
+		)
+	}
+	if r.Plan != nil {
+		env = append(env,
+			"SPEEDTEST_DOWNLOAD_PLAN_PERCENT="+strconv.FormatFloat(r.Plan.DownloadPercent, 'f', 1, 64),
+			"SPEEDTEST_UPLOAD_PLAN_PERCENT="+strconv.FormatFloat(r.Plan.UploadPercent, 'f', 1, 64),
+		)
+	}
+	if r.Grade != nil {
+		env = append(env, "SPEEDTEST_GRADE="+r.Grade.Overall)
+	}
+	if r.Client != nil {
+		env = append(env,
+			"SPEEDTEST_CLIENT_IP="+r.Client.IP,
+			"SPEEDTEST_CLIENT_ISP="+r.Client.ISP,
+		)
+	}
+	if j, err := json.Marshal(r); err == nil {
+		env = append(env, "SPEEDTEST_JSON="+string(j))
+	}
+	return env
+}
+
+// Runs a user supplied hook command through the shell, with env added to the
+// environment. Output goes to stderr to keep it out of the results.
+func runHook(command string, env []string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
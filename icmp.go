@@ -0,0 +1,118 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Protocol numbers used when parsing ICMP messages
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+// Opens an ICMP socket, preferring a raw socket and falling back to the
+// unprivileged datagram sockets available on Linux and macOS
+func listenICMP(ip net.IP) (*icmp.PacketConn, bool, error) {
+	raw, unprivileged, address := "ip4:icmp", "udp4", "0.0.0.0"
+	if ip.To4() == nil {
+		raw, unprivileged, address = "ip6:ipv6-icmp", "udp6", "::"
+	}
+
+	conn, err := icmp.ListenPacket(raw, address)
+	if err == nil {
+		return conn, false, nil
+	}
+	conn, uerr := icmp.ListenPacket(unprivileged, address)
+	if uerr == nil {
+		return conn, true, nil
+	}
+	return nil, false, fmt.Errorf("Could not open ICMP socket: %s, %s", err, uerr)
+}
+
+// Measures latency to ip with ICMP echo requests, used when the speedtest
+// socket protocol port is unreachable
+func (s *Speedtest) PingICMP(ip net.IP, count int) ([]time.Duration, error) {
+	conn, unprivileged, err := listenICMP(ip)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var dst net.Addr = &net.IPAddr{IP: ip}
+	if unprivileged {
+		dst = &net.UDPAddr{IP: ip}
+	}
+
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	protocol := protocolICMP
+	if ip.To4() == nil {
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		protocol = protocolIPv6ICMP
+	}
+
+	id := os.Getpid() & 0xffff
+	reply := make([]byte, 1500)
+	var samples []time.Duration
+	for seq := 0; seq < count; seq++ {
+		msg := icmp.Message{
+			Type: echoType,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("speedtest")},
+		}
+		request, err := msg.Marshal(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		if _, err := conn.WriteTo(request, dst); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(start.Add(s.Timeout))
+
+		for {
+			n, _, err := conn.ReadFrom(reply)
+			if err != nil {
+				return nil, err
+			}
+			rm, err := icmp.ParseMessage(protocol, reply[:n])
+			if err != nil || rm.Type != replyType {
+				continue
+			}
+			// The kernel assigns the ID of unprivileged echo requests
+			echo, ok := rm.Body.(*icmp.Echo)
+			if !ok || echo.Seq != seq || (!unprivileged && echo.ID != id) {
+				continue
+			}
+			samples = append(samples, time.Since(start))
+			break
+		}
+	}
+
+	if len(samples) == 0 {
+		return nil, errors.New("no ICMP echo replies received")
+	}
+	return samples, nil
+}
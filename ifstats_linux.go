@@ -0,0 +1,102 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Kernel receive and transmit byte counters for an interface, read from
+// /proc/net/dev
+func interfaceCounters(name string) (uint64, uint64, error) {
+	f, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != name {
+			continue
+		}
+		// Receive bytes is the first field, transmit bytes the ninth
+		fields := strings.Fields(parts[1])
+		if len(fields) < 9 {
+			break
+		}
+		rx, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		tx, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		return rx, tx, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, fmt.Errorf("interface %s not found in /proc/net/dev", name)
+}
+
+// Negotiated link speed of an interface in bits per second, read from sysfs.
+// Not available for most wireless and virtual interfaces.
+func interfaceSpeed(name string) (float64, error) {
+	data, err := ioutil.ReadFile("/sys/class/net/" + name + "/speed")
+	if err != nil {
+		return 0, err
+	}
+	mbits, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0, err
+	}
+	if mbits <= 0 {
+		return 0, fmt.Errorf("link speed of interface %s is unknown", name)
+	}
+	return mbits * 1000 * 1000, nil
+}
+
+// Kinds of tunnel devices by ARPHRD_* link type, see linux/if_arp.h
+var tunnelLinkTypes = map[string]string{
+	"512":   "PPP",
+	"768":   "IPIP tunnel",
+	"769":   "IPv6 tunnel",
+	"776":   "SIT tunnel",
+	"778":   "GRE tunnel",
+	"823":   "IPv6 GRE tunnel",
+	"65534": "point-to-point tunnel", // ARPHRD_NONE, used by tun and WireGuard
+}
+
+// Kind of tunnel device an interface is, from its link type in sysfs, or
+// empty when it is not a tunnel
+func interfaceTunnel(name string) (string, error) {
+	data, err := ioutil.ReadFile("/sys/class/net/" + name + "/type")
+	if err != nil {
+		return "", err
+	}
+	return tunnelLinkTypes[strings.TrimSpace(string(data))], nil
+}
@@ -0,0 +1,35 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func interfaceCounters(name string) (uint64, uint64, error) {
+	return 0, 0, errors.New("interface counters are only supported on Linux")
+}
+
+func interfaceSpeed(name string) (float64, error) {
+	return 0, errors.New("interface link speed is only supported on Linux")
+}
+
+func interfaceTunnel(name string) (string, error) {
+	return "", errors.New("interface link types are only supported on Linux")
+}
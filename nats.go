@@ -0,0 +1,48 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build nats
+// +build nats
+
+package main
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+func (n *natsWriter) publish(data []byte) error {
+	options := []nats.Option{nats.Name("speedtest"), nats.Timeout(natsTimeout)}
+	if n.creds != "" {
+		options = append(options, nats.UserCredentials(n.creds))
+	}
+	nc, err := nats.Connect(n.url, options...)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	if n.jetStream {
+		js, err := nc.JetStream()
+		if err != nil {
+			return err
+		}
+		_, err = js.Publish(n.subject, data)
+		return err
+	}
+	if err := nc.Publish(n.subject, data); err != nil {
+		return err
+	}
+	return nc.FlushTimeout(natsTimeout)
+}
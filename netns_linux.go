@@ -0,0 +1,65 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const netnsEnv = "SPEEDTEST_NETNS"
+
+// Re-executes the current process inside the named network namespace, in the
+// same way as `ip netns exec`. setns only affects the calling thread, so the
+// namespace is entered on a locked thread which then replaces the process,
+// leaving every thread of the new process inside the namespace.
+func enterNetns(name string) error {
+	if os.Getenv(netnsEnv) == name {
+		return nil
+	}
+
+	nsPath := name
+	if !filepath.IsAbs(nsPath) {
+		nsPath = filepath.Join("/var/run/netns", name)
+	}
+	ns, err := os.Open(nsPath)
+	if err != nil {
+		return fmt.Errorf("Could not open network namespace %s: %s", name, err)
+	}
+	defer ns.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+		return fmt.Errorf("Could not enter network namespace %s: %s", name, err)
+	}
+
+	os.Setenv(netnsEnv, name)
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build otel
+// +build otel
+
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const instrumentationName = "github.com/sivel/speedtest"
+
+// Exports a span for each phase of the run and the results as metrics over
+// OTLP, configured with the standard OTEL_EXPORTER_OTLP_* environment
+// variables. The returned function flushes and shuts down the exporters, and
+// marks the run as failed when failed is true.
+func setupTelemetry(s *Speedtest) (func(failed bool), error) {
+	ctx := context.Background()
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "speedtest"),
+		attribute.String("service.version", version),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	traceExporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(res),
+	)
+	metricExporter, err := otlpmetricgrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)),
+		sdkmetric.WithResource(res),
+	)
+
+	tracer := tracerProvider.Tracer(instrumentationName)
+	runCtx, run := tracer.Start(ctx, "speedtest")
+	s.tracePhase = func(name string) func() {
+		_, span := tracer.Start(runCtx, name)
+		return func() {
+			span.End()
+		}
+	}
+
+	meter := meterProvider.Meter(instrumentationName)
+	download, err := meter.Float64Gauge("speedtest.download", metric.WithUnit("bit/s"), metric.WithDescription("Download speed"))
+	if err != nil {
+		return nil, err
+	}
+	upload, err := meter.Float64Gauge("speedtest.upload", metric.WithUnit("bit/s"), metric.WithDescription("Upload speed"))
+	if err != nil {
+		return nil, err
+	}
+	latency, err := meter.Float64Gauge("speedtest.latency", metric.WithUnit("ms"), metric.WithDescription("Latency to the selected server"))
+	if err != nil {
+		return nil, err
+	}
+	dataUsed, err := meter.Int64Counter("speedtest.data_used", metric.WithUnit("By"), metric.WithDescription("Bytes sent and received by test runs"))
+	if err != nil {
+		return nil, err
+	}
+	s.recordMetrics = func(r *Results) {
+		attrs := []attribute.KeyValue{
+			attribute.Int("server.id", r.Server.ID),
+			attribute.String("server.sponsor", r.Server.Sponsor),
+		}
+		for _, key := range r.Tags.Keys() {
+			attrs = append(attrs, attribute.String(key, r.Tags[key]))
+		}
+		run.SetAttributes(attribute.String("run.id", r.ID), attribute.String("server.id", strconv.Itoa(r.Server.ID)))
+		download.Record(ctx, r.Download, metric.WithAttributes(attrs...))
+		upload.Record(ctx, r.Upload, metric.WithAttributes(attrs...))
+		latency.Record(ctx, r.Latency, metric.WithAttributes(attrs...))
+		dataUsed.Add(ctx, r.DataUsed(), metric.WithAttributes(attrs...))
+	}
+
+	return func(failed bool) {
+		if failed {
+			run.SetStatus(codes.Error, "test failed")
+		}
+		run.End()
+		shutdownCtx, cancel := context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+		tracerProvider.Shutdown(shutdownCtx)
+		meterProvider.Shutdown(shutdownCtx)
+	}, nil
+}
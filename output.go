@@ -0,0 +1,312 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A sink that results are written to, such as an output format on stdout, a
+// database or a message bus
+type OutputWriter interface {
+	WriteResults(r *Results) error
+}
+
+// Adapts an ordinary function to the OutputWriter interface
+type OutputWriterFunc func(r *Results) error
+
+func (f OutputWriterFunc) WriteResults(r *Results) error {
+	return f(r)
+}
+
+// Optional interface for output writers that enable themselves, typically
+// from flags they register in their own init function
+type OutputEnabler interface {
+	Enabled() bool
+}
+
+var (
+	outputWritersLock sync.RWMutex
+	outputWriters     = make(map[string]OutputWriter)
+)
+
+// Makes an output writer available by name. Writers in other files register
+// themselves from init. Panics if the name is already registered.
+func RegisterOutputWriter(name string, w OutputWriter) {
+	outputWritersLock.Lock()
+	defer outputWritersLock.Unlock()
+	if w == nil {
+		panic("speedtest: RegisterOutputWriter writer is nil")
+	}
+	if _, dup := outputWriters[name]; dup {
+		panic("speedtest: RegisterOutputWriter called twice for writer " + name)
+	}
+	outputWriters[name] = w
+}
+
+// Names of the registered output writers, sorted
+func OutputWriters() []string {
+	outputWritersLock.RLock()
+	defer outputWritersLock.RUnlock()
+	var names []string
+	for name := range outputWriters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Output writers that have enabled themselves, sorted by name
+func enabledOutputWriters() []OutputWriter {
+	var outputs []OutputWriter
+	for _, name := range OutputWriters() {
+		outputWritersLock.RLock()
+		w := outputWriters[name]
+		outputWritersLock.RUnlock()
+		if e, ok := w.(OutputEnabler); ok && e.Enabled() {
+			outputs = append(outputs, namedWriter{name, w})
+		}
+	}
+	return outputs
+}
+
+// A registered output writer, named in errors
+type namedWriter struct {
+	name string
+	OutputWriter
+}
+
+func (n namedWriter) String() string {
+	return n.name
+}
+
+// Writes the results with each of the named output writers in turn. All
+// writers are run, and the first error encountered is returned.
+func (r *Results) WriteTo(names ...string) error {
+	var outputs []OutputWriter
+	for _, name := range names {
+		outputWritersLock.RLock()
+		w, ok := outputWriters[name]
+		outputWritersLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown output writer %s", name)
+		}
+		outputs = append(outputs, namedWriter{name, w})
+	}
+	return r.Write(outputs...)
+}
+
+// Writes the results with each of the output writers in turn. All writers
+// are run, and the first error encountered is returned.
+func (r *Results) Write(outputs ...OutputWriter) error {
+	var first error
+	for _, w := range outputs {
+		err := w.WriteResults(r)
+		if err != nil {
+			if name, ok := w.(fmt.Stringer); ok {
+				err = fmt.Errorf("%s output failed: %s", name, err)
+			}
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// TLS configuration for output writers connecting to a sink, verifying it
+// against the CA bundle in caFile and presenting the client certificate in
+// certFile and keyFile, when set
+func outputTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Formats results can be written in, in order of precedence for stdout when
+// more than one is selected
+var outputFormatNames = []string{"json", "jsonl", "xml", "csv", "influx", "simple"}
+
+var outputFormats = map[string]func(r *Results, w io.Writer) error{
+	"json":   (*Results).ToJson,
+	"jsonl":  (*Results).ToJsonCompact,
+	"xml":    (*Results).ToXml,
+	"csv":    (*Results).ToCsv,
+	"influx": (*Results).ToInflux,
+	"simple": (*Results).ToSimple,
+}
+
+// Writes results in a format to a stream, such as stdout
+type formatWriter struct {
+	format string
+	w      io.Writer
+}
+
+func (f formatWriter) WriteResults(r *Results) error {
+	return outputFormats[f.format](r, f.w)
+}
+
+func (f formatWriter) String() string {
+	return f.format
+}
+
+// Writes results in a format to a file, replacing its contents
+type fileWriter struct {
+	format string
+	path   string
+}
+
+// Parses --output, [FORMAT:]PATH, where the format defaults to the one named
+// by the file extension
+func parseFileWriter(value string) (*fileWriter, error) {
+	if i := strings.Index(value, ":"); i > 0 && outputFormats[value[:i]] != nil {
+		return &fileWriter{format: value[:i], path: value[i+1:]}, nil
+	}
+	extensions := map[string]string{
+		".json":  "json",
+		".jsonl": "jsonl",
+		".xml":   "xml",
+		".csv":   "csv",
+		".txt":   "simple",
+		".lp":    "influx",
+	}
+	format, ok := extensions[strings.ToLower(filepath.Ext(value))]
+	if !ok {
+		return nil, fmt.Errorf("cannot determine the output format from the extension, use FORMAT:%s", value)
+	}
+	return &fileWriter{format: format, path: value}, nil
+}
+
+func (f *fileWriter) WriteResults(r *Results) error {
+	out, err := os.Create(f.path)
+	if err != nil {
+		return err
+	}
+	if err := outputFormats[f.format](r, out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (f *fileWriter) String() string {
+	return f.path
+}
+
+// Files results are written to with --output
+type outputFiles []*fileWriter
+
+func (o *outputFiles) String() string {
+	var paths []string
+	for _, f := range *o {
+		paths = append(paths, f.path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func (o *outputFiles) Set(value string) error {
+	f, err := parseFileWriter(value)
+	if err != nil {
+		return err
+	}
+	*o = append(*o, f)
+	return nil
+}
+
+// Formats selected by --format and the format flags. Formats also given an
+// --output file are only written to that file, and only one other may be
+// selected, which is written to stdout, so that stdout stays parseable.
+func (c *CliFlags) OutputFormats() ([]string, error) {
+	selected := map[string]bool{
+		"json":   c.Json,
+		"jsonl":  c.JsonCompact,
+		"xml":    c.Xml,
+		"csv":    c.Csv,
+		"simple": c.Simple,
+	}
+	if c.Format != "" {
+		for _, format := range strings.Split(c.Format, ",") {
+			if outputFormats[format] == nil {
+				return nil, fmt.Errorf("Invalid output format %s, must be one of %s", format, strings.Join(outputFormatNames, ", "))
+			}
+			selected[format] = true
+		}
+	}
+	files := map[string]bool{}
+	for _, f := range c.Outputs {
+		files[f.format] = true
+	}
+	var formats []string
+	stdout := ""
+	for _, format := range outputFormatNames {
+		if !selected[format] {
+			continue
+		}
+		if !files[format] {
+			if stdout != "" {
+				return nil, fmt.Errorf("Only one of %s and %s can be written to stdout, use --output FORMAT:PATH for the other", stdout, format)
+			}
+			stdout = format
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// Output writer to stdout for the selected format not given an --output file
+func formatWriters(formats []string, files outputFiles) []OutputWriter {
+	written := map[string]bool{}
+	for _, f := range files {
+		written[f.format] = true
+	}
+	for _, format := range formats {
+		if !written[format] {
+			return []OutputWriter{formatWriter{format, os.Stdout}}
+		}
+	}
+	return nil
+}
+
+func init() {
+	for _, format := range outputFormatNames {
+		RegisterOutputWriter(format, formatWriter{format, os.Stdout})
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Environment variable the Home Assistant token is read from when --ha-token
+// is not set
+const haTokenEnv = "SPEEDTEST_HA_TOKEN"
+
+// Time allowed for each request to Home Assistant
+const haTimeout = 10 * time.Second
+
+// Updates download, upload and ping sensors through the Home Assistant REST
+// API
+type homeAssistantWriter struct {
+	url    string
+	token  string
+	prefix string
+}
+
+func (h *homeAssistantWriter) Enabled() bool {
+	return h.url != ""
+}
+
+// State of a Home Assistant sensor, as accepted by POST /api/states/<entity>
+type haState struct {
+	State      string                 `json:"state"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+func (h *homeAssistantWriter) WriteResults(r *Results) error {
+	// Read here rather than as the flag default, which usage output prints
+	if h.token == "" {
+		h.token = os.Getenv(haTokenEnv)
+	}
+	if h.token == "" {
+		return fmt.Errorf("a long-lived access token must be set with --ha-token or $%s", haTokenEnv)
+	}
+	// The test's transport is reused for its proxy and TLS settings, but not
+	// its client, which has no overall timeout
+	client := &http.Client{Timeout: haTimeout}
+	if r.Server != nil && r.Server.speedtest != nil {
+		client.Transport = r.Server.speedtest.HTTPClient.Transport
+	}
+
+	attributes := map[string]interface{}{
+		"timestamp": r.Timestamp,
+		"result_id": r.ID,
+	}
+	if r.Server != nil {
+		attributes["server_id"] = r.Server.ID
+		attributes["server_sponsor"] = r.Server.Sponsor
+		attributes["server_name"] = r.Server.Name
+	}
+	sensors := []struct {
+		name, friendly, unit, deviceClass string
+		value                             float64
+	}{
+		{"download", "Speedtest Download", "Mbit/s", "data_rate", r.Download / 1000 / 1000},
+		{"upload", "Speedtest Upload", "Mbit/s", "data_rate", r.Upload / 1000 / 1000},
+		{"ping", "Speedtest Ping", "ms", "duration", r.Latency},
+	}
+	for _, sensor := range sensors {
+		state := haState{
+			State:      fmt.Sprintf("%.2f", sensor.value),
+			Attributes: map[string]interface{}{},
+		}
+		for key, value := range attributes {
+			state.Attributes[key] = value
+		}
+		state.Attributes["friendly_name"] = sensor.friendly
+		state.Attributes["unit_of_measurement"] = sensor.unit
+		state.Attributes["device_class"] = sensor.deviceClass
+		state.Attributes["state_class"] = "measurement"
+		if err := h.post(client, "sensor."+h.prefix+"_"+sensor.name, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *homeAssistantWriter) post(client *http.Client, entity string, state haState) error {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(h.url, "/")+"/api/states/"+entity, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("updating %s failed: %s", entity, res.Status)
+	}
+	return nil
+}
+
+func init() {
+	h := &homeAssistantWriter{}
+	flag.StringVar(&h.url, "ha-url", "", "Update download, upload and ping sensors on the Home Assistant instance at `URL`, such as http://homeassistant.local:8123")
+	flag.StringVar(&h.token, "ha-token", "", "Home Assistant long-lived access token (default from $"+haTokenEnv+")")
+	flag.StringVar(&h.prefix, "ha-entity-prefix", "speedtest", "Prefix of the Home Assistant sensor entity IDs, such as sensor.speedtest_download")
+	RegisterOutputWriter("homeassistant", h)
+}
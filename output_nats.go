@@ -0,0 +1,58 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build nats
+// +build nats
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"time"
+)
+
+// Time allowed to connect to NATS and publish the results
+const natsTimeout = 10 * time.Second
+
+// Publishes results to a NATS subject, optionally through JetStream so they
+// are persisted until consumed
+type natsWriter struct {
+	url       string
+	subject   string
+	creds     string
+	jetStream bool
+}
+
+func (n *natsWriter) Enabled() bool {
+	return n.url != ""
+}
+
+func (n *natsWriter) WriteResults(r *Results) error {
+	data, err := json.Marshal(r.versioned())
+	if err != nil {
+		return err
+	}
+	return n.publish(data)
+}
+
+func init() {
+	n := &natsWriter{}
+	flag.StringVar(&n.url, "nats-url", "", "Publish the JSON results to the NATS server at `URL`, such as nats://localhost:4222")
+	flag.StringVar(&n.subject, "nats-subject", "speedtest.results", "NATS subject to publish the results to")
+	flag.StringVar(&n.creds, "nats-creds", "", "NATS credentials `FILE` to authenticate with")
+	flag.BoolVar(&n.jetStream, "nats-jetstream", false, "Publish through JetStream and wait for the results to be persisted, the subject must be bound to a stream")
+	RegisterOutputWriter("nats", n)
+}
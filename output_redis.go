@@ -0,0 +1,194 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time allowed to connect to Redis and write the results
+const redisTimeout = 10 * time.Second
+
+// Writes results to Redis, pushing the JSON results onto a list and adding
+// samples to RedisTimeSeries keys
+type redisWriter struct {
+	url      string
+	list     string
+	tsPrefix string
+	caCert   string
+}
+
+func (w *redisWriter) Enabled() bool {
+	return w.url != ""
+}
+
+// Minimal client for the Redis serialization protocol, covering the few
+// commands needed to write results
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Connects to a redis:// or rediss:// URL, authenticating with the user and
+// password and selecting the database in the URL path, when set
+func (w *redisWriter) dial() (*redisConn, error) {
+	u, err := url.Parse(w.url)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "redis":
+		conn, err = dialer.Dial("tcp", host)
+	case "rediss":
+		var config *tls.Config
+		config, err = outputTLSConfig(w.caCert, "", "")
+		if err == nil {
+			conn, err = tls.DialWithDialer(dialer, "tcp", host, config)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme %s, must be redis or rediss", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if password, ok := u.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if user := u.User.Username(); user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		if err := c.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if err := c.do("SELECT", db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Sends a command and reads its reply, returning error replies as errors
+func (c *redisConn) do(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return err
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return errors.New(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		if n >= 0 {
+			_, err = io.CopyN(io.Discard, c.reader, int64(n)+2)
+		}
+		return err
+	}
+	return fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+func (w *redisWriter) WriteResults(r *Results) error {
+	c, err := w.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if w.list != "" {
+		data, err := json.Marshal(r.versioned())
+		if err != nil {
+			return err
+		}
+		if err := c.do("LPUSH", w.list, string(data)); err != nil {
+			return err
+		}
+	}
+
+	if w.tsPrefix != "" {
+		timestamp := strconv.FormatInt(r.Timestamp.UnixNano()/int64(time.Millisecond), 10)
+		samples := []struct {
+			name  string
+			value float64
+		}{
+			{"download", r.Download},
+			{"upload", r.Upload},
+			{"latency", r.Latency},
+		}
+		for _, sample := range samples {
+			// Labels only apply when TS.ADD creates the key
+			err := c.do("TS.ADD", w.tsPrefix+":"+sample.name, timestamp,
+				strconv.FormatFloat(sample.value, 'f', -1, 64),
+				"LABELS", "metric", sample.name, "source", "speedtest")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	w := &redisWriter{}
+	flag.StringVar(&w.url, "redis-url", "", "Write the results to the Redis server at `URL`, such as redis://:password@localhost:6379/0, rediss:// connects over TLS")
+	flag.StringVar(&w.list, "redis-list", "speedtest:results", "Redis list to LPUSH the JSON results onto, empty to disable")
+	flag.StringVar(&w.tsPrefix, "redis-ts-prefix", "", "Add download, upload and latency samples to the RedisTimeSeries keys PREFIX:download, PREFIX:upload and PREFIX:latency")
+	flag.StringVar(&w.caCert, "redis-cacert", "", "PEM encoded CA bundle used to verify the Redis server certificate with rediss")
+	RegisterOutputWriter("redis", w)
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+// Advertised download and upload speeds of an internet plan, 0 when not
+// known
+type Plan struct {
+	Download Rate `json:"download"`
+	Upload   Rate `json:"upload"`
+}
+
+// Measured speeds as a percentage of the advertised plan
+type PlanComparison struct {
+	Download        float64 `json:"download" xml:"download"`                                     // Advertised download in bit/s, 0 when not set
+	Upload          float64 `json:"upload" xml:"upload"`                                         // Advertised upload in bit/s, 0 when not set
+	DownloadPercent float64 `json:"download_percent,omitempty" xml:"download_percent,omitempty"` // Measured download as a percentage of the advertised
+	UploadPercent   float64 `json:"upload_percent,omitempty" xml:"upload_percent,omitempty"`     // Measured upload as a percentage of the advertised
+}
+
+// Compares the measured speeds to the advertised plan, for the tests that
+// were run and the speeds that were advertised
+func (r *Results) ComparePlan(plan Plan, download, upload bool) {
+	if plan.Download == 0 && plan.Upload == 0 {
+		return
+	}
+	r.Plan = &PlanComparison{
+		Download: float64(plan.Download),
+		Upload:   float64(plan.Upload),
+	}
+	if download && plan.Download > 0 {
+		r.Plan.DownloadPercent = r.Download / float64(plan.Download) * 100
+	}
+	if upload && plan.Upload > 0 {
+		r.Plan.UploadPercent = r.Upload / float64(plan.Upload) * 100
+	}
+}
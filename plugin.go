@@ -0,0 +1,68 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// External programs that are passed the results as JSON on stdin
+type pluginWriter []string
+
+func (p *pluginWriter) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pluginWriter) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+func (p *pluginWriter) Enabled() bool {
+	return len(*p) > 0
+}
+
+// Runs each plugin in turn with the JSON results on stdin, output from the
+// plugins goes to stderr to keep it out of the results
+func (p *pluginWriter) WriteResults(r *Results) error {
+	out, err := json.Marshal(r.versioned())
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+	for _, path := range *p {
+		cmd := exec.Command(path)
+		cmd.Stdin = bytes.NewReader(out)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+func init() {
+	plugins := &pluginWriter{}
+	flag.Var(plugins, "output-plugin", "Program to run after each test with the JSON results on stdin, may be repeated")
+	RegisterOutputWriter("plugin", plugins)
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Reads the path MTU and maximum segment size of a connection from the kernel
+func pathMTU(conn net.Conn) (int, int, error) {
+	tcpConn, ok := unwrapConn(conn).(*net.TCPConn)
+	if !ok {
+		return 0, 0, errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var mtu, mss int
+	cerr := raw.Control(func(fd uintptr) {
+		if tcpConn.RemoteAddr().(*net.TCPAddr).IP.To4() != nil {
+			mtu, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU)
+		} else {
+			mtu, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU)
+		}
+		if err != nil {
+			return
+		}
+		mss, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG)
+	})
+	if cerr != nil {
+		return 0, 0, cerr
+	}
+	return mtu, mss, err
+}
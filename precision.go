@@ -0,0 +1,61 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// Exact measurements kept with --profile lan, as rates in bits/s and
+// latencies in ms hide differences that matter on fast local links
+type Precision struct {
+	DownloadBytes    int64   `json:"download_bytes" xml:"download_bytes"`
+	DownloadDuration int64   `json:"download_duration_ns" xml:"download_duration_ns"`
+	UploadBytes      int64   `json:"upload_bytes" xml:"upload_bytes"`
+	UploadDuration   int64   `json:"upload_duration_ns" xml:"upload_duration_ns"`
+	LatencySamples   []int64 `json:"latency_samples_ns" xml:"latency_samples_ns>sample"`
+}
+
+// Records the latency samples of the selected server in ns
+func (p *Precision) setLatency(samples []time.Duration) {
+	p.LatencySamples = make([]int64, len(samples))
+	for i, sample := range samples {
+		p.LatencySamples[i] = sample.Nanoseconds()
+	}
+}
+
+// Suggests pinning the test to CPUs close to the network card, as on 10
+// Gbit/s and faster links the scheduler moving workers between CPUs and
+// NUMA nodes costs more than the link
+func (s *Speedtest) cpuHints(iface string) {
+	allowed, err := cpuAffinity()
+	if err != nil {
+		s.Debugf("Could not read the CPU affinity: %s", err)
+		return
+	}
+	if allowed >= runtime.NumCPU() {
+		cpus, err := localCPUs(iface)
+		if err == nil && cpus != "" {
+			s.Printf("Hint: pin the test to the CPUs local to %s, such as with taskset -c %s, and keep interrupts off them\n", iface, cpus)
+		} else {
+			s.Printf("Hint: pin the test to the CPUs on the network card's NUMA node, such as with taskset, and keep interrupts off them\n")
+		}
+	}
+	if allowed < s.Threads {
+		s.Printf("Hint: %d connections share %d CPUs, pin the test to more CPUs or lower --threads\n", s.Threads, allowed)
+	}
+}
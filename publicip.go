@@ -0,0 +1,110 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Services that respond with the address a request came from as plain text,
+// tried in order until one responds. All of them support IPv4 and IPv6.
+var ipLookupURLs = []string{
+	"https://icanhazip.com/",
+	"https://ifconfig.co/ip",
+	"https://api64.ipify.org/",
+	"https://ident.me/",
+}
+
+// Time allowed for each lookup service to respond, short as they are only
+// tried for extra metadata
+const ipLookupTimeout = 3 * time.Second
+
+// Public IPv4 and IPv6 addresses of this host, as seen by IP lookup services,
+// each empty when it has no address of that family or no service responded
+func (s *Speedtest) PublicIPs() (string, string) {
+	var ipv4, ipv6 string
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ipv4 = s.lookupPublicIP("tcp4")
+	}()
+	go func() {
+		defer wg.Done()
+		ipv6 = s.lookupPublicIP("tcp6")
+	}()
+	wg.Wait()
+	return ipv4, ipv6
+}
+
+// Public address of one family, trying each lookup service in turn
+func (s *Speedtest) lookupPublicIP(network string) string {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+				return s.dialContext(ctx, network, address)
+			},
+			TLSClientConfig: s.TLSConfig,
+		},
+	}
+	for _, url := range ipLookupURLs {
+		ip, err := fetchPublicIP(client, url, network == "tcp6")
+		if err == nil {
+			s.Debugf("Public %s address from %s: %s", network, url, ip)
+			return ip
+		}
+		s.Debugf("Could not look up public %s address with %s: %s", network, url, err)
+	}
+	return ""
+}
+
+func fetchPublicIP(client *http.Client, url string, ipv6 bool) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ipLookupTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", res.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 256))
+	if err != nil {
+		return "", err
+	}
+
+	// Captive portals and errors pages are not addresses
+	text := strings.TrimSpace(string(body))
+	ip := net.ParseIP(text)
+	if ip == nil || (ip.To4() == nil) != ipv6 {
+		return "", fmt.Errorf("unexpected response %q", text)
+	}
+	return ip.String(), nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Longest a single read or write is allowed to take at the limited rate, so
+// that a large buffer cannot hold a worker past the end of a test
+const rateLimitSlice = 100 * time.Millisecond
+
+// Smallest read or write allowed by a rate limiter, however low the rate
+const rateLimitMinChunk = 1500
+
+// Paces transfers shared by any number of connections to a rate in bytes
+// per second, for --limit-rate. Unused time is not saved up, so transfers
+// never burst above the rate after an idle period.
+type rateLimiter struct {
+	lock sync.Mutex
+	rate float64
+	next time.Time
+}
+
+// Returns a limiter for a rate in bits/s, or nil when rate is 0
+func newRateLimiter(bps float64) *rateLimiter {
+	if bps <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: bps / 8}
+}
+
+// Largest transfer of up to n bytes that fits in a single slice of time
+func (l *rateLimiter) chunk(n int) int {
+	if l == nil {
+		return n
+	}
+	max := int(l.rate * rateLimitSlice.Seconds())
+	if max < rateLimitMinChunk {
+		max = rateLimitMinChunk
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// Blocks until n more bytes may be transferred without exceeding the rate
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	l.lock.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Time to wait for each hop to respond when tracing the route
+const routeHopTimeout = time.Second
+
+// Default gateway and first hops of the route used for the test, to tell
+// which LAN and uplink a measurement came from
+type Route struct {
+	Gateway string     `json:"gateway,omitempty" xml:"gateway,omitempty"`
+	Hops    []RouteHop `json:"hops,omitempty" xml:"hops>hop,omitempty"`
+}
+
+// A router on the route to the server
+type RouteHop struct {
+	TTL     int     `json:"ttl" xml:"ttl,attr"`
+	Address string  `json:"address" xml:"address,attr"` // Empty when the hop did not respond
+	RTT     float64 `json:"rtt" xml:"rtt,attr"`         // Round trip time in ms
+}
+
+// Traces up to maxHops hops of the route to ip with ICMP echo requests of
+// increasing TTL, stopping early when ip is reached. Requires a raw ICMP
+// socket, as unprivileged sockets do not receive time exceeded messages.
+func (s *Speedtest) TraceRoute(ip net.IP, maxHops int) ([]RouteHop, error) {
+	conn, unprivileged, err := listenICMP(ip)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if unprivileged {
+		return nil, errors.New("tracing the route requires privileges to open a raw ICMP socket")
+	}
+
+	var echoType, replyType, exceededType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply, ipv4.ICMPTypeTimeExceeded
+	protocol := protocolICMP
+	if ip.To4() == nil {
+		echoType, replyType, exceededType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, ipv6.ICMPTypeTimeExceeded
+		protocol = protocolIPv6ICMP
+	}
+
+	id := os.Getpid() & 0xffff
+	reply := make([]byte, 1500)
+	var hops []RouteHop
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		if ip.To4() != nil {
+			err = conn.IPv4PacketConn().SetTTL(ttl)
+		} else {
+			err = conn.IPv6PacketConn().SetHopLimit(ttl)
+		}
+		if err != nil {
+			return hops, err
+		}
+
+		msg := icmp.Message{
+			Type: echoType,
+			Body: &icmp.Echo{ID: id, Seq: ttl, Data: []byte("speedtest")},
+		}
+		request, err := msg.Marshal(nil)
+		if err != nil {
+			return hops, err
+		}
+		start := time.Now()
+		if _, err := conn.WriteTo(request, &net.IPAddr{IP: ip}); err != nil {
+			return hops, err
+		}
+		conn.SetReadDeadline(start.Add(routeHopTimeout))
+
+		hop := RouteHop{TTL: ttl}
+		reached := false
+		for {
+			n, peer, err := conn.ReadFrom(reply)
+			if err != nil {
+				// The hop did not respond
+				break
+			}
+			rm, err := icmp.ParseMessage(protocol, reply[:n])
+			if err != nil {
+				continue
+			}
+			if rm.Type == replyType {
+				if echo, ok := rm.Body.(*icmp.Echo); !ok || echo.ID != id || echo.Seq != ttl {
+					continue
+				}
+				reached = true
+			} else if rm.Type == exceededType {
+				if body, ok := rm.Body.(*icmp.TimeExceeded); !ok || !exceededEcho(body.Data, protocol, id, ttl) {
+					continue
+				}
+			} else {
+				continue
+			}
+			hop.Address = peer.String()
+			hop.RTT = float64(time.Since(start)) / float64(time.Millisecond)
+			break
+		}
+		hops = append(hops, hop)
+		if reached {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// Whether a time exceeded message quotes our echo request, the quoted
+// datagram being the original IP header followed by the ICMP header
+func exceededEcho(data []byte, protocol, id, seq int) bool {
+	header := 40
+	if protocol == protocolICMP {
+		if len(data) < 1 {
+			return false
+		}
+		header = int(data[0]&0x0f) * 4
+	}
+	if len(data) < header+8 {
+		return false
+	}
+	echo := data[header:]
+	return int(echo[4])<<8|int(echo[5]) == id && int(echo[6])<<8|int(echo[7]) == seq
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Architectures that store integers big-endian, /proc/net/route prints
+// IPv4 addresses in host byte order
+var bigEndianArchs = map[string]bool{"mips": true, "mips64": true, "ppc64": true, "s390x": true, "sparc64": true}
+
+// Default gateway of the IPv4 or IPv6 routing table, preferring the default
+// route through iface when there are several
+func defaultGateway(iface string, ipv6 bool) (string, error) {
+	if ipv6 {
+		return defaultGateway6(iface)
+	}
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gateway := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || value == 0 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		if bigEndianArchs[runtime.GOARCH] {
+			binary.BigEndian.PutUint32(ip, uint32(value))
+		} else {
+			binary.LittleEndian.PutUint32(ip, uint32(value))
+		}
+		if fields[0] == iface {
+			return ip.String(), nil
+		}
+		if gateway == "" {
+			gateway = ip.String()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if gateway == "" {
+		return "", fmt.Errorf("no IPv4 default route")
+	}
+	return gateway, nil
+}
+
+func defaultGateway6(iface string) (string, error) {
+	f, err := os.Open("/proc/net/ipv6_route")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gateway := ""
+	zero := strings.Repeat("0", 32)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Destination PrefixLen Source PrefixLen NextHop Metric RefCnt Use Flags Iface
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[0] != zero || fields[1] != "00" || fields[4] == zero {
+			continue
+		}
+		b, err := hex.DecodeString(fields[4])
+		if err != nil || len(b) != net.IPv6len {
+			continue
+		}
+		ip := net.IP(b).String()
+		if fields[9] == iface {
+			return ip, nil
+		}
+		if gateway == "" {
+			gateway = ip
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if gateway == "" {
+		return "", fmt.Errorf("no IPv6 default route")
+	}
+	return gateway, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the JSON and XML results schema. Fields are only ever added
+// within a version, the version is bumped when fields are renamed, removed or
+// change meaning.
+//
+//	1: download, upload, latency, server, timestamp and share
+//	2: adds schema_version and the extended results, the current schema
+const schemaVersion = 2
+
+// Results as emitted by schema version 1
+type resultsV1 struct {
+	XMLName   xml.Name  `json:"-" xml:"results"`
+	Download  float64   `json:"download" xml:"download"`
+	Upload    float64   `json:"upload" xml:"upload"`
+	Latency   float64   `json:"latency" xml:"latency"`
+	Server    *Server   `json:"server" xml:"server"`
+	Timestamp time.Time `json:"timestamp" xml:"timestamp"`
+	Share     string    `json:"share" xml:"share"`
+}
+
+// Parses a schema version in the form vN
+func parseSchemaVersion(value string) (int, error) {
+	version, err := strconv.Atoi(strings.TrimPrefix(value, "v"))
+	if err != nil || !strings.HasPrefix(value, "v") || version < 1 || version > schemaVersion {
+		return 0, fmt.Errorf("Invalid schema version %s, must be one of v1 to v%d", value, schemaVersion)
+	}
+	return version, nil
+}
+
+// Results in the shape of the schema version or compatibility format they
+// are set to emit
+func (r *Results) versioned() interface{} {
+	if r.compat == "python" {
+		return r.pythonCompat()
+	}
+	if r.SchemaVersion == 1 {
+		return &resultsV1{
+			Download:  r.Download,
+			Upload:    r.Upload,
+			Latency:   r.Latency,
+			Server:    r.Server,
+			Timestamp: r.Timestamp,
+			Share:     r.Share,
+		}
+	}
+	return r
+}
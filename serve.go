@@ -0,0 +1,736 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Set in the environment of test runs started by serve mode, so that they
+// report progress on stderr
+const progressEnv = "SPEEDTEST_PROGRESS"
+
+// Prefix of progress lines written to stderr by test runs
+const progressPrefix = "PROGRESS "
+
+var errRunning = errors.New("a test is already running")
+
+// Counters published at /debug/vars by serve mode with --debug-endpoints
+var (
+	runsCounter          = expvar.NewInt("runs")
+	failuresCounter      = expvar.NewInt("failures")
+	bytesSentCounter     = expvar.NewInt("bytes_sent")
+	bytesReceivedCounter = expvar.NewInt("bytes_received")
+)
+
+// Web UI showing the latest result, live progress and a history chart
+//
+//go:embed dashboard.html
+var dashboard []byte
+
+// Writes a progress event to stderr for the serve mode parent process
+func writeProgress(event ProgressEvent) {
+	line, _ := json.Marshal(event)
+	fmt.Fprintf(os.Stderr, "%s%s\n", progressPrefix, line)
+}
+
+// Event published to subscribers of a Runner
+type Event struct {
+	Name string      // progress or status
+	Data interface{} // ProgressEvent or RunStatus
+}
+
+// State of the most recent test run
+type RunStatus struct {
+	Running  bool       `json:"running"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Result   string     `json:"result,omitempty"` // ID of the results of the run
+}
+
+// Runs tests on demand and on a schedule for serve mode, one at a time,
+// recording results in the history
+type Runner struct {
+	history    *History
+	reschedule chan struct{}
+
+	lock        sync.Mutex
+	args        []string      // Options passed to each test run
+	interval    time.Duration // Time between scheduled runs, 0 when not scheduled
+	cooldown    time.Duration // Minimum time between the end of a run and the start of the next
+	finished    time.Time     // End of the most recent run
+	runs        int           // Runs finished so far
+	maxRuns     int           // Runs after which done is closed, 0 for no limit
+	done        chan struct{}
+	summary     Summary // Runs since the runner was created
+	pool        []int   // Preferred servers, each run starts from the next
+	poolNext    int
+	blackout    Blackout // Windows of the day without scheduled runs
+	quickOnly   bool     // Run quick tests during blackout windows instead of none
+	status      RunStatus
+	subscribers map[chan Event]struct{}
+	cmd         *exec.Cmd // Child process of the current run
+}
+
+func NewRunner(args []string, history *History) *Runner {
+	return &Runner{
+		history:     history,
+		reschedule:  make(chan struct{}, 1),
+		args:        args,
+		subscribers: make(map[chan Event]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Limits the number of runs, Done is closed once they have finished
+func (r *Runner) SetMaxRuns(maxRuns int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.maxRuns = maxRuns
+}
+
+// Closed when the maximum number of runs have finished
+func (r *Runner) Done() <-chan struct{} {
+	return r.done
+}
+
+// Replaces the options and interval of test runs. A run in progress is not
+// interrupted, the options apply from the next run.
+func (r *Runner) Configure(args []string, interval time.Duration) {
+	r.lock.Lock()
+	r.args = args
+	r.interval = interval
+	r.lock.Unlock()
+	select {
+	case r.reschedule <- struct{}{}:
+	default:
+	}
+}
+
+// Sets the windows of the day during which scheduled runs are skipped, or
+// run as quick tests when quick is set. Runs started on demand are not
+// affected.
+func (r *Runner) SetBlackout(blackout Blackout, quick bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.blackout = blackout
+	r.quickOnly = quick
+}
+
+// Whether a scheduled run at t should be skipped, or run as a quick test,
+// because of a blackout window
+func (r *Runner) blackedOut(t time.Time) (skip, quick bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.blackout.Contains(t) {
+		return false, false
+	}
+	return !r.quickOnly, r.quickOnly
+}
+
+// Starts a run every interval, when one is configured, until stop is closed
+func (r *Runner) Schedule(stop chan struct{}) {
+	for {
+		r.lock.Lock()
+		interval := r.interval
+		r.lock.Unlock()
+
+		var next <-chan time.Time
+		if interval > 0 {
+			next = time.After(interval)
+		}
+		select {
+		case <-next:
+			skip, quick := r.blackedOut(time.Now())
+			if skip {
+				fmt.Printf("Skipping scheduled run during blackout %s\n", r.blackoutString())
+				continue
+			}
+			r.start(quick)
+		case <-r.reschedule:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (r *Runner) blackoutString() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.blackout.String()
+}
+
+// Starts a test run in the background
+func (r *Runner) Start() (RunStatus, error) {
+	return r.start(false)
+}
+
+// Starts a test run in the background, a quick test when quick is set
+func (r *Runner) start(quick bool) (RunStatus, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.status.Running {
+		return r.status, errRunning
+	}
+	now := time.Now()
+	r.status = RunStatus{Running: true, Started: &now}
+	r.publish(Event{Name: "status", Data: r.status})
+	go r.run(quick)
+	return r.status, nil
+}
+
+// Stops the current run, if any, when shutting down
+func (r *Runner) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cmd != nil {
+		r.cmd.Process.Kill()
+	}
+}
+
+// Returns a channel receiving events until it is passed to Unsubscribe
+func (r *Runner) Subscribe() chan Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ch := make(chan Event, 16)
+	r.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (r *Runner) Unsubscribe(ch chan Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.subscribers, ch)
+}
+
+// Sends an event to all subscribers, dropping it for subscribers that are
+// not keeping up. Must be called with the lock held.
+func (r *Runner) publish(event Event) {
+	for ch := range r.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Summary of the runs so far
+func (r *Runner) Summary() Summary {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.summary
+}
+
+// Status of the current or most recent run
+func (r *Runner) Status() RunStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.status
+}
+
+// Sets a pool of preferred servers. Each run tries them in order starting
+// from the server after the one the previous run started from, so load is
+// spread across them while unresponsive servers are skipped.
+func (r *Runner) SetPool(pool []int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pool = pool
+}
+
+// Sets the minimum time between the end of a run and the start of the next,
+// so consecutive runs do not interfere with each other
+func (r *Runner) SetCooldown(cooldown time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cooldown = cooldown
+}
+
+func (r *Runner) run(quick bool) {
+	r.lock.Lock()
+	wait := r.cooldown - time.Since(r.finished)
+	r.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+
+	runsCounter.Add(1)
+	results, err := r.execute(quick)
+	if err == nil {
+		bytesSentCounter.Add(results.BytesSent)
+		bytesReceivedCounter.Add(results.BytesReceived)
+		err = r.history.Add(results)
+	}
+	if err != nil {
+		failuresCounter.Add(1)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	r.status.Running = false
+	r.status.Finished = &now
+	r.finished = now
+	r.runs++
+	r.summary.Add(results, err)
+	if r.runs == r.maxRuns {
+		close(r.done)
+	}
+	if err != nil {
+		r.status.Error = err.Error()
+	}
+	if results != nil {
+		r.status.Result = results.ID
+	}
+	r.publish(Event{Name: "status", Data: r.status})
+}
+
+// Runs a test in a child process, so that every run starts from a clean
+// state and a failing run cannot take the server down with it. With quick,
+// the test is run with --quick.
+func (r *Runner) execute(quick bool) (*Results, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	args := append([]string{}, r.args...)
+	if len(r.pool) > 0 && !hasFlag(args, "pool") {
+		next := r.poolNext % len(r.pool)
+		var ids []string
+		for _, id := range append(append([]int{}, r.pool[next:]...), r.pool[:next]...) {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		args = append(args, "--pool", strings.Join(ids, ","))
+		r.poolNext = next + 1
+	}
+	r.lock.Unlock()
+	if quick && !hasFlag(args, "quick") {
+		args = append(args, "--quick")
+	}
+	if !hasFlag(args, "lock-file") {
+		args = append(args, "--lock-file", defaultLockFile())
+	}
+	cmd := exec.Command(exe, append(args, "--json")...)
+	cmd.Env = append(os.Environ(), progressEnv+"=1")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	r.cmd = cmd
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		r.cmd = nil
+		r.lock.Unlock()
+	}()
+
+	// Publish progress lines, passing anything else through
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var event ProgressEvent
+		if strings.HasPrefix(line, progressPrefix) && json.Unmarshal([]byte(line[len(progressPrefix):]), &event) == nil {
+			r.lock.Lock()
+			r.publish(Event{Name: "progress", Data: event})
+			r.lock.Unlock()
+			continue
+		}
+		fmt.Fprintln(os.Stderr, line)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		// Invalid results are reported, but kept out of the history
+		var exitErr *exec.ExitError
+		results := &Results{}
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == invalidExitCode && json.Unmarshal(out.Bytes(), results) == nil {
+			return nil, fmt.Errorf("results are invalid, %s", strings.Join(results.InvalidReasons, ", "))
+		}
+		// Errors are reported on stdout
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+
+	results := &Results{}
+	if err := json.Unmarshal(out.Bytes(), results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Lock file used by test runs started by serve and agent mode, so that they
+// do not overlap with tests started by cron or by hand with the same lock
+func defaultLockFile() string {
+	return filepath.Join(os.TempDir(), "speedtest.lock")
+}
+
+// Whether args set the named flag, in any of the forms the flag package
+// accepts
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		arg = strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		if arg == name {
+			return true
+		}
+	}
+	return false
+}
+
+// REST API and dashboard for serve mode
+func (r *Runner) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/run", r.handleRun)
+	mux.HandleFunc("/api/status", r.handleStatus)
+	mux.HandleFunc("/api/results/latest", r.history.handleLatest)
+	mux.HandleFunc("/api/history", r.history.handleHistory)
+	mux.HandleFunc("/api/events", r.handleEvents)
+	mux.HandleFunc("/api/summary", r.handleSummary)
+	mux.HandleFunc("/", handleDashboard)
+	return mux
+}
+
+// POST /api/run triggers a test run
+func (r *Runner) handleRun(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	status, err := r.Start()
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// GET /api/status returns the state of the current or most recent run
+func (r *Runner) handleStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, r.Status())
+}
+
+// GET /api/summary returns a summary of the runs since the server started
+func (r *Runner) handleSummary(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, r.Summary())
+}
+
+// GET /api/results/latest returns the results of the most recent run
+func (h *History) handleLatest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	latest := h.Latest()
+	if latest == nil {
+		writeError(w, http.StatusNotFound, "no results")
+		return
+	}
+	writeJSON(w, http.StatusOK, latest)
+}
+
+// GET /api/history returns the results of past runs, oldest first, limited
+// to the most recent runs by the limit query parameter
+func (h *History) handleHistory(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	limit := 0
+	if value := req.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit "+value)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, h.List(limit))
+}
+
+// GET /api/events streams progress and status events as server-sent events
+func (r *Runner) handleEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	events := r.Subscribe()
+	defer r.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "event: status\ndata: %s\n\n", encodeJSON(r.Status()))
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-events:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, encodeJSON(event.Data))
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// The pprof profiling endpoints at /debug/pprof/ and the expvar counters at
+// /debug/vars, served on their own listener as they are not authenticated
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", debugVars)
+	return mux
+}
+
+// Serves the published variables as expvar.Handler does, leaving out the
+// command line, as options passed to test runs may include keys and tokens
+func debugVars(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// GET / serves the dashboard
+func handleDashboard(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboard)
+}
+
+// JSON encoding of a value that is known to be encodable
+func encodeJSON(v interface{}) []byte {
+	out, _ := json.Marshal(v)
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func serveUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, `usage: %s serve [options] [-- test options]
+
+Serve a REST API that runs tests on demand and provides their results, and a
+dashboard showing them at /.
+
+Endpoints:
+  POST /api/run             Start a test run
+  GET  /api/status          State of the current or most recent run
+  GET  /api/results/latest  Results of the most recent run
+  GET  /api/history         Results of past runs, ?limit=N for the latest N
+  GET  /api/events          Server-sent progress and status events
+  GET  /api/summary         Summary of the runs since the server started
+
+options:
+`, path.Base(os.Args[0]))
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+}
+
+// Entry point of the serve subcommand
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = serveUsage(fs)
+	api := fs.String("api", ":8080", "Address to serve the REST API and dashboard on, empty to disable")
+	grpcAddr := fs.String("grpc", "", "Address to serve the gRPC API on (requires building with -tags grpc)")
+	historyPath := fs.String("history", "", "Append results to the JSON lines history `FILE`, history is kept in memory only when not set")
+	historyKey := fs.String("history-key", "", "Encrypt the history with the hex or base64 encoded AES-256 key in `FILE`")
+	historyMigrate := fs.Bool("history-migrate", false, "Encrypt history written before --history-key was set, which is otherwise rejected")
+	interval := fs.Duration("interval", 0, "Also run a test every interval, such as 1h")
+	configPath := fs.String("config", "", "JSON configuration `FILE` with schedule and test settings, reloaded on SIGHUP")
+	maxRuns := fs.Int("max-runs", 0, "Stop after N test runs, 0 runs until stopped")
+	until := fs.String("until", "", "Stop at a time of day such as 23:00, or an RFC 3339 timestamp")
+	summaryInterval := fs.Duration("summary-interval", 0, "Print a summary of the runs so far every interval, such as 1h, a summary is always printed on exit")
+	cooldown := fs.Duration("cooldown", 0, "Minimum time between the end of a test run and the start of the next, such as 30s")
+	var blackout Blackout
+	fs.Var(&blackout, "blackout", "Daily `WINDOWS` of local time without scheduled runs, such as 09:00-17:00, comma separated or repeated")
+	blackoutQuick := fs.Bool("blackout-quick", false, "Run quick tests during --blackout windows rather than none")
+	debugEndpoints := fs.Bool("debug-endpoints", false, "Serve pprof profiles at /debug/pprof/ and run counters at /debug/vars on --debug-listen")
+	debugListen := fs.String("debug-listen", "localhost:6060", "Address to serve --debug-endpoints on, separately from the API as they are not authenticated")
+	fs.Parse(args)
+
+	history, err := OpenHistory(*historyPath, *historyKey, *historyMigrate)
+	if err != nil {
+		errorf("Could not load history %s: %s", *historyPath, err)
+	}
+	runner := NewRunner(nil, history)
+	runner.SetCooldown(*cooldown)
+	runner.SetMaxRuns(*maxRuns)
+	go func() {
+		<-runner.Done()
+		fmt.Printf("Finished %d runs, stopping\n", *maxRuns)
+		stopDaemon()
+	}()
+	if *until != "" {
+		end, err := parseUntil(*until, time.Now())
+		if err != nil {
+			errorf(err.Error())
+		}
+		fmt.Printf("Stopping at %s\n", end.Format(time.RFC1123))
+		time.AfterFunc(time.Until(end), stopDaemon)
+	}
+	configure := func() error {
+		args, every, pool := fs.Args(), *interval, []int(nil)
+		windows, quick := blackout, *blackoutQuick
+		if *configPath != "" {
+			config, err := LoadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+			args = config.TestArgs(args)
+			// Test runs read the plan and budget from the same file
+			if !hasFlag(args, "config") {
+				args = append(args, "--config", *configPath)
+			}
+			pool = config.Pool
+			if config.Interval.Duration > 0 {
+				every = config.Interval.Duration
+			}
+			if len(config.Blackout) > 0 {
+				windows, _ = parseBlackout(config.Blackout)
+				quick = config.BlackoutQuick
+			}
+		}
+		runner.SetPool(pool)
+		runner.SetBlackout(windows, quick)
+		runner.Configure(args, every)
+		return nil
+	}
+	if err := configure(); err != nil {
+		errorf("Could not load configuration %s: %s", *configPath, err)
+	}
+	stop := make(chan struct{})
+	go runner.Schedule(stop)
+	if *summaryInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(*summaryInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					fmt.Println(runner.Summary())
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	if *api == "" && *grpcAddr == "" {
+		errorf("At least one of --api or --grpc must be set")
+	}
+	if *debugEndpoints && *debugListen == "" {
+		errorf("--debug-listen must be set with --debug-endpoints")
+	}
+	server := &http.Server{Addr: *api, Handler: runner.Handler()}
+	debugServer := &http.Server{Addr: *debugListen, Handler: debugHandler()}
+	runDaemon(func() error {
+		errs := make(chan error, 3)
+		if *debugEndpoints {
+			fmt.Printf("Serving debug endpoints on %s\n", *debugListen)
+			go func() {
+				errs <- debugServer.ListenAndServe()
+			}()
+		}
+		if *grpcAddr != "" {
+			fmt.Printf("Serving gRPC API on %s\n", *grpcAddr)
+			go func() {
+				errs <- serveGRPC(*grpcAddr, runner)
+			}()
+		}
+		if *api != "" {
+			fmt.Printf("Serving API on %s\n", *api)
+			go func() {
+				errs <- server.ListenAndServe()
+			}()
+		}
+		return <-errs
+	}, func() {
+		close(stop)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+		debugServer.Shutdown(ctx)
+		runner.Stop()
+		fmt.Println(runner.Summary())
+	}, configure)
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Name the Windows service is installed as
+const serviceName = "speedtest"
+
+// Runs a daemon subcommand under the Windows service control manager
+type windowsService struct {
+	args []string
+}
+
+func (w *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		runSubcommand(w.args)
+		close(done)
+	}()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				stopDaemon()
+				<-done
+				return false, 0
+			}
+		case <-done:
+			return false, 1
+		}
+	}
+}
+
+// Installs, starts, stops, uninstalls or runs the Windows service
+func service(args []string) {
+	if len(args) == 0 {
+		serviceUsage()
+	}
+
+	if args[0] == "run" {
+		if err := svc.Run(serviceName, &windowsService{args: args[1:]}); err != nil {
+			errorf("Could not run service: %s", err)
+		}
+		return
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		errorf("Could not connect to the service manager: %s", err)
+	}
+	defer m.Disconnect()
+
+	switch args[0] {
+	case "install":
+		if len(args) < 2 || !isDaemonSubcommand(args[1]) {
+			serviceUsage()
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			errorf(err.Error())
+		}
+		exe, err = filepath.Abs(exe)
+		if err != nil {
+			errorf(err.Error())
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "speedtest",
+			Description: "Tests internet bandwidth using speedtest.net",
+			StartType:   mgr.StartAutomatic,
+		}, append([]string{"service", "run"}, args[1:]...)...)
+		if err != nil {
+			errorf("Could not install service: %s", err)
+		}
+		s.Close()
+		fmt.Printf("Installed service %s\n", serviceName)
+	case "uninstall", "start", "stop":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			errorf("Could not open service %s: %s", serviceName, err)
+		}
+		defer s.Close()
+		switch args[0] {
+		case "uninstall":
+			err = s.Delete()
+		case "start":
+			err = s.Start()
+		case "stop":
+			_, err = s.Control(svc.Stop)
+		}
+		if err != nil {
+			errorf("Could not %s service %s: %s", args[0], serviceName, err)
+		}
+		fmt.Printf("Service %s: %s requested\n", serviceName, args[0])
+	default:
+		serviceUsage()
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Environment variable the signing key is read from when --sign-key is not set
+const signKeyEnv = "SPEEDTEST_SIGN_KEY"
+
+// Fields of the results covered by the signature, one name=value pair per
+// line. The set is fixed so signatures survive fields being added to the
+// schema, and records being round tripped through history files.
+func (r *Results) canonical() []byte {
+	float := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	fields := [][2]string{
+		{"schema_version", strconv.Itoa(r.SchemaVersion)},
+		{"id", r.ID},
+		{"timestamp", r.Timestamp.UTC().Format(time.RFC3339Nano)},
+		{"hostname", r.Hostname},
+		{"download", float(r.Download)},
+		{"upload", float(r.Upload)},
+		{"latency", float(r.Latency)},
+		{"bytes_sent", strconv.FormatInt(r.BytesSent, 10)},
+		{"bytes_received", strconv.FormatInt(r.BytesReceived, 10)},
+		{"invalid", strconv.FormatBool(r.Invalid)},
+	}
+	if r.Client != nil {
+		fields = append(fields, [2]string{"client.ip", r.Client.IP}, [2]string{"client.isp", r.Client.ISP})
+	}
+	if r.Server != nil {
+		fields = append(fields, [2]string{"server.id", strconv.Itoa(r.Server.ID)}, [2]string{"server.host", r.Server.Host})
+	}
+
+	var buf bytes.Buffer
+	for _, field := range fields {
+		fmt.Fprintf(&buf, "%s=%s\n", field[0], field[1])
+	}
+	return buf.Bytes()
+}
+
+func (r *Results) signature(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(r.canonical())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Signs the results with an HMAC-SHA256 of their canonical fields, making
+// records tamper-evident for anyone holding the key
+func (r *Results) Sign(key []byte) {
+	r.Signature = r.signature(key)
+}
+
+// Whether the results carry a valid signature made with key
+func (r *Results) VerifySignature(key []byte) bool {
+	signature, err := hex.DecodeString(r.Signature)
+	if err != nil || r.Signature == "" {
+		return false
+	}
+	expected, _ := hex.DecodeString(r.signature(key))
+	return hmac.Equal(signature, expected)
+}
+
+// Decodes results from a JSON array, or from one or more JSON objects such as
+// a JSON lines history file
+func decodeResults(r io.Reader) ([]*Results, error) {
+	reader := bufio.NewReader(r)
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		reader.ReadByte()
+	}
+
+	var all []*Results
+	decoder := json.NewDecoder(reader)
+	if b, _ := reader.Peek(1); b[0] == '[' {
+		err := decoder.Decode(&all)
+		return all, err
+	}
+	for {
+		results := &Results{}
+		if err := decoder.Decode(results); err == io.EOF {
+			return all, nil
+		} else if err != nil {
+			return nil, err
+		}
+		all = append(all, results)
+	}
+}
+
+func verifyUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, `usage: %s verify [options] FILE
+
+Verify the signatures of results written with --sign-key, in JSON output,
+JSON lines history files or exports. Exits with a non-zero status when any
+record is unsigned or its signature does not match.
+
+options:
+`, path.Base(os.Args[0]))
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+}
+
+// Entry point of the verify subcommand
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = verifyUsage(fs)
+	key := fs.String("sign-key", "", "Key the results were signed with (default from $"+signKeyEnv+")")
+	fs.Parse(args)
+	if *key == "" {
+		*key = os.Getenv(signKeyEnv)
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+	if *key == "" {
+		errorf("--sign-key or $%s is required", signKeyEnv)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		errorf("Could not read results %s: %s", fs.Arg(0), err)
+	}
+	all, err := decodeResults(f)
+	f.Close()
+	if err != nil {
+		errorf("Could not read results %s: %s", fs.Arg(0), err)
+	}
+
+	failed := 0
+	for _, results := range all {
+		status := "ok"
+		if results.Signature == "" {
+			status = "unsigned"
+		} else if !results.VerifySignature([]byte(*key)) {
+			status = "invalid signature"
+		}
+		if status != "ok" {
+			failed++
+		}
+		fmt.Printf("%s %s %s\n", results.Timestamp.Local().Format(time.RFC3339), results.ID, status)
+	}
+	if failed > 0 {
+		errorf("%d of %d results failed verification", failed, len(all))
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Binds all connections, including HTTP requests, to the --vrf device
+func (s *Speedtest) bindControl(network, address string, c syscall.RawConn) error {
+	if s.CliFlags.VRF == "" {
+		return nil
+	}
+
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.BindToDevice(int(fd), s.CliFlags.VRF)
+		if err != nil {
+			err = fmt.Errorf("Could not bind to VRF %s: %s", s.CliFlags.VRF, err)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Applies socket options to test connections before they are connected
+func (s *Speedtest) control(network, address string, c syscall.RawConn) error {
+	if err := s.bindControl(network, address, c); err != nil {
+		return err
+	}
+
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if s.CliFlags.Congestion != "" {
+			err = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, s.CliFlags.Congestion)
+			if err != nil {
+				err = fmt.Errorf("Could not set congestion control algorithm %s: %s", s.CliFlags.Congestion, err)
+				return
+			}
+		}
+
+		if s.CliFlags.DSCP != 0 {
+			// DSCP occupies the upper 6 bits of the TOS / traffic class byte
+			if network == "tcp6" {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, s.CliFlags.DSCP<<2)
+			} else {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, s.CliFlags.DSCP<<2)
+			}
+			if err != nil {
+				err = fmt.Errorf("Could not set DSCP value %d: %s", s.CliFlags.DSCP, err)
+				return
+			}
+		}
+
+		if s.CliFlags.FwMark != 0 {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, s.CliFlags.FwMark)
+			if err != nil {
+				err = fmt.Errorf("Could not set firewall mark %d: %s", s.CliFlags.FwMark, err)
+				return
+			}
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Reads the effective socket buffer sizes, which the kernel doubles from the
+// requested values to allow for bookkeeping overhead
+func socketBufferSizes(conn net.Conn) (int, int, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, 0, errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var sndbuf, rcvbuf int
+	cerr := raw.Control(func(fd uintptr) {
+		sndbuf, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		if err != nil {
+			return
+		}
+		rcvbuf, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if cerr != nil {
+		return 0, 0, cerr
+	}
+	return sndbuf, rcvbuf, err
+}
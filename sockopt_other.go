@@ -0,0 +1,53 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func (s *Speedtest) bindControl(network, address string, c syscall.RawConn) error {
+	if s.CliFlags.VRF != "" {
+		return errors.New("Binding to a VRF is only supported on Linux")
+	}
+	return nil
+}
+
+// Socket options that are only available on Linux are rejected here
+func (s *Speedtest) control(network, address string, c syscall.RawConn) error {
+	if err := s.bindControl(network, address, c); err != nil {
+		return err
+	}
+	if s.CliFlags.Congestion != "" {
+		return errors.New("Selecting a congestion control algorithm is only supported on Linux")
+	}
+	if s.CliFlags.DSCP != 0 {
+		return errors.New("DSCP marking is only supported on Linux")
+	}
+	if s.CliFlags.FwMark != 0 {
+		return errors.New("Firewall marks are only supported on Linux")
+	}
+	return nil
+}
+
+func socketBufferSizes(conn net.Conn) (int, int, error) {
+	return 0, 0, errors.New("reading socket buffer sizes is only supported on Linux")
+}
@@ -16,7 +16,11 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/csv"
 	"encoding/json"
 	"encoding/xml"
@@ -25,8 +29,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
 	"path"
@@ -35,6 +42,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kellydunn/golang-geo"
@@ -42,109 +50,819 @@ import (
 
 const (
 	version = "0.0.1"
+
+	// Used when neither --threads nor the configuration specify a thread count
+	defaultThreads = 8
+
+	// Used when the configuration does not specify the download and upload
+	// test lengths, in seconds
+	defaultDownloadLength = 15
+	defaultUploadLength   = 10
+
+	// Number of times each request size is queued for the download and upload
+	// tests
+	requestsPerSize = 4
+
+	// Default size of the buffers used to read from test connections
+	defaultReadBuffer = 128 * 1024
+
+	// Largest single DOWNLOAD and UPLOAD request sent to a server, unless
+	// overridden. Upload requests can be no larger than the upload payload.
+	downloadChunkSize  = 1000000
+	uploadChunkSize    = 100000
+	maxUploadChunkSize = 1000000
+
+	// CPU usage during a test, as a fraction of all available CPUs, above
+	// which the result is likely limited by this host rather than the link
+	cpuSaturationThreshold = 0.9
+
+	// Fraction of the average connection throughput below which a connection
+	// is considered imbalanced
+	imbalanceThreshold = 0.5
+
+	// Ethernet MTU, smaller path MTUs usually indicate tunneling such as
+	// PPPoE or a VPN
+	standardMTU = 1500
+
+	// Room left for TCP options, such as timestamps, when comparing the MSS
+	// to the path MTU
+	tcpOptionsSize = 12
+
+	// Precision in km that the server distance is rounded to by --anonymize
+	anonymizedDistance = 10
+
+	// speedtest.net API that results are submitted to for --share
+	shareURL = "https://www.speedtest.net/api/api.php"
+
+	// Number of times to try submitting results for --share, and the delay
+	// before the first retry, which doubles after each attempt
+	shareAttempts   = 3
+	shareRetryDelay = time.Second
+
+	// Maximum number of servers probed for latency at once
+	latencyWorkers = 5
+
+	// Exit code when the results fail validation, distinct from the 1 of
+	// other failures
+	invalidExitCode = 3
+
+	// Tolerance above the interface link speed before a result is considered
+	// implausible
+	lineRateTolerance = 1.05
+
+	// Number of sets of candidates probed for latency before giving up, each
+	// only probed when none of the previous set responded
+	latencyTranches = 3
+
+	// Servers latency tested when the client location is unknown, as they
+	// cannot be narrowed down by distance first
+	latencyOnlyCandidates = 20
+
+	// Delay between starting connection attempts to each address of a server,
+	// as recommended by RFC 8305
+	connectionAttemptDelay = 250 * time.Millisecond
+
+	// Longest time spent finishing a request interrupted by the end of a test,
+	// so that its connection can be reused by the next test
+	drainTimeout = time.Second
+
+	// Length of the download probe run by --adaptive
+	probeLength = 2 * time.Second
+
+	// Settings used by --quick unless explicitly overridden
+	quickThreads = 4
+	quickLength  = 5 * time.Second
+
+	// Settings used by --profile multi-gig unless explicitly overridden
+	multiGigThreads      = 16
+	multiGigSocketBuffer = 4 * 1024 * 1024
+	multiGigReadBuffer   = 1024 * 1024
+	multiGigRamp         = 2 * time.Second
+
+	// Settings used by --profile lan in addition to the multi-gig ones,
+	// unless explicitly overridden
+	lanLength    = 30 * time.Second
+	lanRamp      = 5 * time.Second
+	lanPingCount = 20
 )
 
+// Formats a number of bytes using decimal units
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1000*1000*1000:
+		return fmt.Sprintf("%.02f GB", float64(n)/1000/1000/1000)
+	case n >= 1000*1000:
+		return fmt.Sprintf("%.02f MB", float64(n)/1000/1000)
+	case n >= 1000:
+		return fmt.Sprintf("%.02f kB", float64(n)/1000)
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// Functions called by errorf before exiting, such as hooks reporting the
+// failure
+var errorHooks []func()
+
 // Helper function to make it easier for printing and exiting
 func errorf(text string, a ...interface{}) {
 	if !strings.HasSuffix(text, "\n") {
 		text += "\n"
 	}
 	fmt.Printf(text, a...)
+	for _, hook := range errorHooks {
+		hook()
+	}
 	os.Exit(1)
 }
 
-// Established connection with local address and timeout support
-func dialTimeout(network string, laddr *net.TCPAddr, raddr *net.TCPAddr, timeout time.Duration) (net.Conn, error) {
-	dialer := &net.Dialer{
-		Timeout:   timeout,
-		LocalAddr: laddr,
+// Static host:port to IP address overrides, in the style of curl's --resolve
+type Resolves map[string]string
+
+func (r Resolves) String() string {
+	var entries []string
+	for hostport, addr := range r {
+		host, port, _ := net.SplitHostPort(hostport)
+		entries = append(entries, fmt.Sprintf("%s:%s:%s", host, port, addr))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// Parse a HOST:PORT:ADDRESS entry, ADDRESS may be a bracketed IPv6 address
+func (r Resolves) Set(value string) error {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 {
+		return errors.New("expected HOST:PORT:ADDRESS")
+	}
+	host, port, addr := strings.ToLower(parts[0]), parts[1], strings.Trim(parts[2], "[]")
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return errors.New("invalid port " + port)
+	}
+	if net.ParseIP(addr) == nil {
+		return errors.New("invalid IP address " + addr)
+	}
+	r[net.JoinHostPort(host, port)] = addr
+	return nil
+}
+
+// Returns the address that should be connected to for hostport
+func (r Resolves) Lookup(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	if addr, ok := r[net.JoinHostPort(strings.ToLower(host), port)]; ok {
+		return net.JoinHostPort(addr, port)
+	}
+	return hostport
+}
+
+// Custom key=value labels attached to results
+type Tags map[string]string
+
+// Tag keys in sorted order
+func (t Tags) Keys() []string {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (t Tags) String() string {
+	var entries []string
+	for _, key := range t.Keys() {
+		entries = append(entries, key+"="+t[key])
+	}
+	return strings.Join(entries, ",")
+}
+
+// Parse a KEY=VALUE entry
+func (t Tags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.New("expected KEY=VALUE")
+	}
+	t[parts[0]] = parts[1]
+	return nil
+}
+
+// Marshal tags as <tag key="KEY">VALUE</tag> elements, as maps cannot be
+// marshaled to XML
+func (t Tags) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type tag struct {
+		Key   string `xml:"key,attr"`
+		Value string `xml:",chardata"`
+	}
+	var tags struct {
+		Tags []tag `xml:"tag"`
+	}
+	for _, key := range t.Keys() {
+		tags.Tags = append(tags.Tags, tag{Key: key, Value: t[key]})
+	}
+	return e.EncodeElement(tags, start)
+}
+
+// Set of server IDs, such as servers excluded from selection
+type ServerIDs map[int]bool
+
+func (ids ServerIDs) String() string {
+	var entries []string
+	for id := range ids {
+		entries = append(entries, strconv.Itoa(id))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// Parse a comma separated list of server IDs
+func (ids ServerIDs) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(entry))
+		if err != nil {
+			return fmt.Errorf("invalid server ID %s", entry)
+		}
+		ids[id] = true
 	}
+	return nil
+}
+
+// Ordered list of server IDs, such as a pool of preferred servers
+type ServerList []int
+
+func (l *ServerList) String() string {
+	var entries []string
+	for _, id := range *l {
+		entries = append(entries, strconv.Itoa(id))
+	}
+	return strings.Join(entries, ",")
+}
+
+// Parse a comma separated list of server IDs, appending to the list
+func (l *ServerList) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(entry))
+		if err != nil {
+			return fmt.Errorf("invalid server ID %s", entry)
+		}
+		*l = append(*l, id)
+	}
+	return nil
+}
+
+// Request sizes, in bytes, that are queued for the download and upload tests
+var (
+	defaultDownloadSizes = []int{245388, 505544, 1118012, 1986284, 4468241, 7907740, 12407926, 17816816, 24262167, 31625365}
+	defaultUploadSizes   = []int{32768, 65536, 131072, 262144, 524288, 1048576, 7340032}
+
+	quickDownloadSizes = []int{245388, 505544, 1118012, 1986284, 4468241}
+	quickUploadSizes   = []int{32768, 65536, 131072, 262144, 524288}
+
+	// Split into chunks when requested, large enough not to run out before
+	// the end of the test at 10 Gbit/s
+	multiGigDownloadSizes = []int{100000000, 250000000, 500000000, 1000000000}
+	multiGigUploadSizes   = []int{10000000, 50000000, 100000000, 250000000}
+)
+
+// Test settings chosen by --adaptive for links up to maxRate bits/s
+type adaptiveTier struct {
+	maxRate       float64
+	threads       int
+	length        time.Duration
+	downloadSizes []int
+	uploadSizes   []int
+}
+
+var adaptiveTiers = []adaptiveTier{
+	{10e6, 2, 10 * time.Second, defaultDownloadSizes[:4], defaultUploadSizes[:4]},
+	{100e6, 4, 10 * time.Second, defaultDownloadSizes[:7], defaultUploadSizes[:6]},
+	{1000e6, 8, 10 * time.Second, defaultDownloadSizes[2:], defaultUploadSizes[2:]},
+	{math.Inf(1), 16, 15 * time.Second, defaultDownloadSizes[4:], defaultUploadSizes[4:]},
+}
+
+// Comma separated list of sizes in bytes
+type Sizes []int
+
+func (z *Sizes) String() string {
+	var sizes []string
+	for _, size := range *z {
+		sizes = append(sizes, strconv.Itoa(size))
+	}
+	return strings.Join(sizes, ",")
+}
+
+func (z *Sizes) Set(value string) error {
+	var sizes Sizes
+	for _, field := range strings.Split(value, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size < 1 {
+			return errors.New("invalid size " + field)
+		}
+		sizes = append(sizes, size)
+	}
+	*z = sizes
+	return nil
+}
+
+// Number of bytes, accepting decimal (KB, MB, GB) and binary (KiB, MiB, GiB)
+// unit suffixes
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KIB", 1 << 10},
+	{"MIB", 1 << 20},
+	{"GIB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"K", 1000},
+	{"M", 1000 * 1000},
+	{"G", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+func (b *ByteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *ByteSize) Set(value string) error {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return errors.New("invalid size " + value)
+	}
+	*b = ByteSize(size * float64(multiplier))
+	return nil
+}
 
-	conn, err := dialer.Dial(network, raddr.String())
-	return conn, err
+// Reads a size from JSON as a string such as "50GB", or a number of bytes
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case string:
+		return b.Set(v)
+	case float64:
+		return b.Set(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return fmt.Errorf("invalid size %s", data)
 }
 
 type CliFlags struct {
-	List        bool
-	Server      int
-	Interactive bool // Not a direct flag, this is derived from whether a user has or has not selected a machine readable output
-	Json        bool
-	Xml         bool
-	Csv         bool
-	Simple      bool
-	Source      string
-	Timeout     int64
-	Share       bool
-	Version     bool
+	List           bool
+	Server         int
+	Resolve        Resolves
+	Interactive    bool // Not a direct flag, this is derived from whether a user has or has not selected a machine readable output
+	Json           bool
+	JsonCompact    bool
+	Xml            bool
+	Csv            bool
+	CsvExtended    bool
+	Simple         bool
+	Source         string
+	Timeout        int64
+	ConnectTimeout time.Duration
+	IOTimeout      time.Duration
+	Insecure       bool
+	Secure         bool
+	Transport      string
+	Duplex         bool
+	PlanDownload   Rate
+	PlanUpload     Rate
+	MonthlyBudget  ByteSize
+	LimitRate      Rate
+	Config         string
+	QUICURL        string
+	Congestion     string
+	DSCP           int
+	FwMark         int
+	SendBuffer     int
+	RecvBuffer     int
+	Nagle          bool
+	KeepAlive      time.Duration
+	Netns          string
+	VRF            string
+	Threads        int
+	DownloadTime   time.Duration
+	UploadTime     time.Duration
+	DownloadSizes  Sizes
+	UploadSizes    Sizes
+	MaxBytes       ByteSize
+	ReadBuffer     ByteSize
+	DownloadChunk  ByteSize
+	UploadChunk    ByteSize
+	Ramp           time.Duration
+	Profile        string
+	EstimateOnly   bool
+	Quick          bool
+	NoDownload     bool
+	NoUpload       bool
+	Adaptive       bool
+	IfCounters     bool
+	PathMTU        bool
+	PingCount      int
+	Candidates     int
+	Select         string
+	Debug          bool
+	CACert         string
+	Share          bool
+	ShareSave      string
+	SubmitURL      string
+	Anonymize      bool
+	Tags           Tags
+	PingURL        string
+	LockFile       string
+	Otel           bool
+	PreHook        string
+	Schema         string
+	Format         string
+	Progress       string
+	Outputs        outputFiles
+	Exclude        ServerIDs
+	Pool           ServerList
+	Compat         string
+	DistanceUnit   string
+	RateUnit       string
+	GeoIPDB        string
+	ExpectISP      string
+	RouteHops      int
+	SignKey        string
+	SkipIPLookup   bool
+	Latitude       float64
+	Longitude      float64
+	PostHook       string
+	Version        bool
 }
 
 func NewCliFlags() *CliFlags {
 	return &CliFlags{
-		Interactive: true,
+		Interactive:   true,
+		Resolve:       Resolves{},
+		Tags:          Tags{},
+		DownloadSizes: append(Sizes{}, defaultDownloadSizes...),
+		UploadSizes:   append(Sizes{}, defaultUploadSizes...),
+		ReadBuffer:    defaultReadBuffer,
+		DownloadChunk: downloadChunkSize,
+		UploadChunk:   uploadChunkSize,
 	}
 }
 
 type Results struct {
-	XMLName   xml.Name  `json:"-" xml:"results"`
-	Download  float64   `json:"download" xml:"download"`
-	Upload    float64   `json:"upload" xml:"upload"`
-	Latency   float64   `json:"latency" xml:"latency"`
-	Server    *Server   `json:"server" xml:"server"`
-	Timestamp time.Time `json:"timestamp" xml:"timestamp"`
-	Share     string    `json:"share" xml:"share"`
+	SchemaVersion   int                `json:"schema_version" xml:"schema_version"`
+	ID              string             `json:"id" xml:"id"`
+	Hostname        string             `json:"hostname" xml:"hostname"`
+	OS              string             `json:"os" xml:"os"`
+	Arch            string             `json:"arch" xml:"arch"`
+	Version         string             `json:"version" xml:"version"`
+	InterfaceName   string             `json:"interface_name" xml:"interface_name"`
+	Route           *Route             `json:"route,omitempty" xml:"route,omitempty"`
+	PublicIPv4      string             `json:"public_ipv4,omitempty" xml:"public_ipv4,omitempty"`
+	PublicIPv6      string             `json:"public_ipv6,omitempty" xml:"public_ipv6,omitempty"`
+	ClientASN       *ASNInfo           `json:"client_asn,omitempty" xml:"client_asn,omitempty"`
+	ServerASN       *ASNInfo           `json:"server_asn,omitempty" xml:"server_asn,omitempty"`
+	VPN             bool               `json:"vpn" xml:"vpn"`
+	VPNReasons      []string           `json:"vpn_reasons,omitempty" xml:"vpn_reasons>reason,omitempty"`
+	XMLName         xml.Name           `json:"-" xml:"results"`
+	Download        float64            `json:"download" xml:"download"`
+	Upload          float64            `json:"upload" xml:"upload"`
+	Latency         float64            `json:"latency" xml:"latency"`
+	LatencyMin      float64            `json:"latency_min" xml:"latency_min"`
+	LatencyMax      float64            `json:"latency_max" xml:"latency_max"`
+	LatencyStdDev   float64            `json:"latency_stddev" xml:"latency_stddev"`
+	LatencyMethod   string             `json:"latency_method" xml:"latency_method"`
+	Server          *Server            `json:"server" xml:"server"`
+	Client          *Client            `json:"client" xml:"client"`
+	Timestamp       time.Time          `json:"timestamp" xml:"timestamp"`
+	Share           string             `json:"share" xml:"share"`
+	BytesSent       int64              `json:"bytes_sent" xml:"bytes_sent"`
+	BytesReceived   int64              `json:"bytes_received" xml:"bytes_received"`
+	Approximate     bool               `json:"approximate" xml:"approximate"`
+	CPUSaturated    bool               `json:"cpu_saturated" xml:"cpu_saturated"`
+	Interface       *InterfaceCounters `json:"interface,omitempty" xml:"interface,omitempty"`
+	DownloadConns   []ConnectionStats  `json:"download_connections" xml:"download_connections>connection"`
+	UploadConns     []ConnectionStats  `json:"upload_connections" xml:"upload_connections>connection"`
+	Imbalanced      bool               `json:"imbalanced" xml:"imbalanced"`
+	Invalid         bool               `json:"invalid" xml:"invalid"`
+	InvalidReasons  []string           `json:"invalid_reasons,omitempty" xml:"invalid_reasons>reason,omitempty"`
+	AddressFamily   string             `json:"address_family" xml:"address_family"`
+	Secure          bool               `json:"secure" xml:"secure"`
+	Transport       string             `json:"transport" xml:"transport"`
+	Endpoint        string             `json:"endpoint,omitempty" xml:"endpoint,omitempty"` // URL throughput was measured against with --transport quic, rather than the server
+	Duplex          bool               `json:"duplex" xml:"duplex"`
+	RateLimit       float64            `json:"rate_limit,omitempty" xml:"rate_limit,omitempty"`         // Cap in bits/s set with --limit-rate
+	LoadedLatency   float64            `json:"loaded_latency,omitempty" xml:"loaded_latency,omitempty"` // Mean latency in ms while a duplex test ran
+	Grade           *Grade             `json:"grade,omitempty" xml:"grade,omitempty"`
+	Plan            *PlanComparison    `json:"plan,omitempty" xml:"plan,omitempty"`
+	Precision       *Precision         `json:"precision,omitempty" xml:"precision,omitempty"`
+	DownloadTCP     *TCPStats          `json:"download_tcp,omitempty" xml:"download_tcp,omitempty"`
+	UploadTCP       *TCPStats          `json:"upload_tcp,omitempty" xml:"upload_tcp,omitempty"`
+	DownloadSamples []float64          `json:"download_samples" xml:"download_samples>sample"`
+	UploadSamples   []float64          `json:"upload_samples" xml:"upload_samples>sample"`
+	DNS             []DNSTiming        `json:"dns" xml:"dns>lookup"`
+	Tags            Tags               `json:"tags" xml:"tags"`
+	PathMTU         *PathMTU           `json:"path_mtu,omitempty" xml:"path_mtu,omitempty"`
+	Signature       string             `json:"signature,omitempty" xml:"signature,omitempty"`
+
+	compat       string
+	csvExtended  bool
+	distanceUnit DistanceUnit
+	rateUnit     RateUnit
+}
+
+// Time taken to resolve a hostname, in milliseconds
+type DNSTiming struct {
+	Host string  `json:"host" xml:"host,attr"`
+	Time float64 `json:"time" xml:"time"`
+}
+
+// Masks the client IP address to its /24 (IPv4) or /48 (IPv6) network and
+// removes the client coordinates, so results can be published. The distance
+// to the server is rounded, as it could otherwise be used to locate the client.
+func (r *Results) Anonymize() {
+	r.PublicIPv4 = anonymizeIP(r.PublicIPv4)
+	r.PublicIPv6 = anonymizeIP(r.PublicIPv6)
+	if r.Client != nil {
+		client := *r.Client
+		client.IP = anonymizeIP(client.IP)
+		client.Latitude = 0
+		client.Longitude = 0
+		r.Client = &client
+	}
+	if r.Server != nil {
+		server := *r.Server
+		server.Distance = math.Round(server.Distance/anonymizedDistance) * anonymizedDistance
+		r.Server = &server
+	}
+	if r.Route != nil {
+		route := *r.Route
+		route.Hops = make([]RouteHop, len(r.Route.Hops))
+		for i, hop := range r.Route.Hops {
+			hop.Address = anonymizeIP(hop.Address)
+			route.Hops[i] = hop
+		}
+		r.Route = &route
+	}
+}
+
+// Masks an IP address to its /24 or /48 network, or empty when it is not an
+// IP address
+func anonymizeIP(value string) string {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// Checks the results are plausible, marking them invalid with the reasons
+// when they are not. lineRate is the link speed of the test interface in
+// bits/s, or 0 when unknown, and download and upload are whether those tests
+// were run.
+func (r *Results) Validate(lineRate float64, download, upload bool) bool {
+	r.InvalidReasons = nil
+	if r.Latency <= 0 {
+		r.InvalidReasons = append(r.InvalidReasons, "latency of 0 ms")
+	}
+	if download && r.Download <= 0 {
+		r.InvalidReasons = append(r.InvalidReasons, "download of 0 bits/s")
+	}
+	if upload && r.Upload <= 0 {
+		r.InvalidReasons = append(r.InvalidReasons, "upload of 0 bits/s")
+	}
+	if lineRate > 0 {
+		limit := lineRate * lineRateTolerance
+		if r.Download > limit {
+			r.InvalidReasons = append(r.InvalidReasons, fmt.Sprintf("download of %.02f Mbit/s exceeds the %.0f Mbit/s interface link speed", r.Download/1000/1000, lineRate/1000/1000))
+		}
+		if r.Upload > limit {
+			r.InvalidReasons = append(r.InvalidReasons, fmt.Sprintf("upload of %.02f Mbit/s exceeds the %.0f Mbit/s interface link speed", r.Upload/1000/1000, lineRate/1000/1000))
+		}
+	}
+	r.Invalid = len(r.InvalidReasons) > 0
+	return !r.Invalid
+}
+
+// Total bytes sent and received during the run, including the configuration
+// and server list retrieval and latency tests
+func (r *Results) DataUsed() int64 {
+	return r.BytesSent + r.BytesReceived
+}
+
+// Bytes observed by the OS on the test interface during each test, alongside
+// the bytes measured by the application, to validate results
+type InterfaceCounters struct {
+	Name             string `json:"name" xml:"name,attr"`
+	DownloadBytes    uint64 `json:"download_bytes" xml:"download_bytes"`
+	DownloadMeasured int64  `json:"download_measured" xml:"download_measured"`
+	UploadBytes      uint64 `json:"upload_bytes" xml:"upload_bytes"`
+	UploadMeasured   int64  `json:"upload_measured" xml:"upload_measured"`
 }
 
 func NewResults() *Results {
+	hostname, _ := os.Hostname()
 	return &Results{
-		Timestamp: time.Now(),
+		SchemaVersion: schemaVersion,
+		ID:            newUUID(),
+		Hostname:      hostname,
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		Version:       version,
+		Timestamp:     time.Now(),
+	}
+}
+
+// Random (version 4) UUID identifying a run, so that results aggregated from
+// many hosts can be deduplicated
+func newUUID() string {
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		// Fall back to math/rand rather than failing the run
+		rand.Read(b[:])
 	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
-// Marshall results to JSON and print
-func (r *Results) ToJson() {
-	out, err := json.MarshalIndent(r, "", "    ")
+// Marshall results to JSON and write them to w
+func (r *Results) ToJson(w io.Writer) error {
+	out, err := json.MarshalIndent(r.versioned(), "", "    ")
 	if err != nil {
-		errorf(err.Error())
+		return err
 	}
-	fmt.Println(string(out))
+	_, err = fmt.Fprintln(w, string(out))
+	return err
 }
 
-// Marshal results to XML and print
-func (r *Results) ToXml() {
-	out, err := xml.MarshalIndent(r, "", "    ")
+// Marshal results to JSON on a single line and write them to w, for log
+// shippers and JSON lines files
+func (r *Results) ToJsonCompact(w io.Writer) error {
+	out, err := json.Marshal(r.versioned())
 	if err != nil {
-		errorf(err.Error())
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+// Marshal results to XML and write them to w
+func (r *Results) ToXml(w io.Writer) error {
+	out, err := xml.MarshalIndent(r.versioned(), "", "    ")
+	if err != nil {
+		return err
 	}
-	fmt.Printf("%s%s", xml.Header, string(out))
+	_, err = fmt.Fprintf(w, "%s%s", xml.Header, string(out))
+	return err
 }
 
 // Output results as CSV
 // Format is:
-//    ID,Sponsor,Name,Timestamp,Distance (km),Latency (ms),Download (bits/s),Upload (bits/s)
-func (r *Results) ToCsv() {
+//    ID,Sponsor,Name,Timestamp,Distance (km or mi),Latency (ms),Download (bits/s),Upload (bits/s)
+//
+// With --csv-extended, followed by Data Used (bytes), Tags, Download Plan (%)
+// and Upload Plan (%), the plan columns empty without an advertised plan
+func (r *Results) ToCsv(w io.Writer) error {
 	record := []string{
 		strconv.Itoa(r.Server.ID),
 		r.Server.Sponsor,
 		r.Server.Name,
 		r.Timestamp.Format(time.RFC3339),
-		strconv.FormatFloat(r.Server.Distance, 'f', -1, 64),
+		strconv.FormatFloat(r.distanceUnit.FromKm(r.Server.Distance), 'f', -1, 64),
 		strconv.FormatFloat(r.Latency, 'f', -1, 64),
 		strconv.FormatFloat(r.Download, 'f', -1, 64),
 		strconv.FormatFloat(r.Upload, 'f', -1, 64),
 	}
-	w := csv.NewWriter(os.Stdout)
-	w.Write(record)
-	w.Flush()
+	// Only added on request, so existing consumers see the same columns
+	if r.csvExtended {
+		downloadPlan, uploadPlan := "", ""
+		if r.Plan != nil {
+			downloadPlan = strconv.FormatFloat(r.Plan.DownloadPercent, 'f', -1, 64)
+			uploadPlan = strconv.FormatFloat(r.Plan.UploadPercent, 'f', -1, 64)
+		}
+		record = append(record, strconv.FormatInt(r.DataUsed(), 10), r.Tags.String(), downloadPlan, uploadPlan)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(record)
+	cw.Flush()
+	return cw.Error()
+}
+
+// Escapes commas, equals signs and spaces in InfluxDB line protocol tag keys
+// and values
+var influxEscaper = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+
+// Output results as a single InfluxDB line protocol measurement, as expected
+// by the Telegraf exec input
+func (r *Results) ToInflux(w io.Writer) error {
+	tags := Tags{}
+	if r.Hostname != "" {
+		tags["host"] = r.Hostname
+	}
+	if r.Server != nil {
+		tags["server_id"] = strconv.Itoa(r.Server.ID)
+		tags["server_sponsor"] = r.Server.Sponsor
+		tags["server_name"] = r.Server.Name
+	}
+	if r.Client != nil && r.Client.ISP != "" {
+		tags["isp"] = r.Client.ISP
+	}
+	if r.ClientASN != nil {
+		tags["client_asn"] = strconv.FormatUint(uint64(r.ClientASN.Number), 10)
+	}
+	if r.ServerASN != nil {
+		tags["server_asn"] = strconv.FormatUint(uint64(r.ServerASN.Number), 10)
+	}
+	for key, value := range r.Tags {
+		tags[key] = value
+	}
+
+	var line strings.Builder
+	line.WriteString("speedtest")
+	for _, key := range tags.Keys() {
+		if tags[key] == "" {
+			continue
+		}
+		fmt.Fprintf(&line, ",%s=%s", influxEscaper.Replace(key), influxEscaper.Replace(tags[key]))
+	}
+	fmt.Fprintf(&line, " download=%s,upload=%s,latency=%s,bytes_sent=%di,bytes_received=%di",
+		strconv.FormatFloat(r.Download, 'f', -1, 64),
+		strconv.FormatFloat(r.Upload, 'f', -1, 64),
+		strconv.FormatFloat(r.Latency, 'f', -1, 64),
+		r.BytesSent, r.BytesReceived)
+	if r.Plan != nil {
+		fmt.Fprintf(&line, ",download_plan_percent=%s,upload_plan_percent=%s",
+			strconv.FormatFloat(r.Plan.DownloadPercent, 'f', -1, 64),
+			strconv.FormatFloat(r.Plan.UploadPercent, 'f', -1, 64))
+	}
+	fmt.Fprintf(&line, " %d", r.Timestamp.UnixNano())
+	_, err := fmt.Fprintln(w, line.String())
+	return err
 }
 
 // Output results in "simple" format
-func (r *Results) ToSimple() {
-	fmt.Printf("Latency: %.02f ms\n", r.Latency)
-	fmt.Printf("Download: %.02f Mbit/s\n", r.Download/1000/1000)
-	fmt.Printf("Upload: %.02f Mbit/s\n", r.Upload/1000/1000)
+func (r *Results) ToSimple(w io.Writer) error {
+	fmt.Fprintf(w, "Latency: %.02f ms\n", r.Latency)
+	fmt.Fprintf(w, "Download: %s\n", r.rateUnit.Format(r.Download))
+	fmt.Fprintf(w, "Upload: %s\n", r.rateUnit.Format(r.Upload))
+	if r.Endpoint != "" {
+		fmt.Fprintf(w, "Throughput measured against: %s\n", r.Endpoint)
+	}
+	if r.Plan != nil {
+		if r.Plan.DownloadPercent > 0 {
+			fmt.Fprintf(w, "Download of plan: %.01f%% of %s\n", r.Plan.DownloadPercent, r.rateUnit.Format(r.Plan.Download))
+		}
+		if r.Plan.UploadPercent > 0 {
+			fmt.Fprintf(w, "Upload of plan: %.01f%% of %s\n", r.Plan.UploadPercent, r.rateUnit.Format(r.Plan.Upload))
+		}
+	}
+	fmt.Fprintf(w, "Data used: %s\n", formatBytes(r.DataUsed()))
+	if len(r.Tags) > 0 {
+		fmt.Fprintf(w, "Tags: %s\n", r.Tags)
+	}
+	for _, lookup := range r.DNS {
+		fmt.Fprintf(w, "DNS lookup (%s): %.02f ms\n", lookup.Host, lookup.Time)
+	}
+	if r.PathMTU != nil {
+		fmt.Fprintf(w, "Path MTU: %d (MSS %d)\n", r.PathMTU.MTU, r.PathMTU.MSS)
+		if r.PathMTU.Reduced {
+			fmt.Fprintln(w, "Warning: path MTU is reduced, which is common with PPPoE or VPN links and can reduce throughput")
+		}
+	}
+	if r.Approximate {
+		fmt.Fprintln(w, "Results are approximate, a quick test was run")
+	}
+	if r.CPUSaturated {
+		fmt.Fprintln(w, "Warning: CPU usage was high, results may understate the link speed")
+	}
+	if r.Imbalanced {
+		fmt.Fprintln(w, "Warning: throughput was imbalanced between connections, which may indicate per flow policing")
+	}
+	if r.Invalid {
+		fmt.Fprintf(w, "Warning: results are invalid, %s\n", strings.Join(r.InvalidReasons, ", "))
+	}
+	return nil
 }
 
-func (r *Results) ToPng() {
+// Result form expected by the speedtest.net API, signed with its hash
+func (r *Results) shareForm() url.Values {
+	s := r.Server.speedtest
 	kDownload := strconv.FormatFloat(r.Download/1000, 'f', 0, 64)
 	kUpload := strconv.FormatFloat(r.Upload/1000, 'f', 0, 64)
 	latency := strconv.FormatFloat(r.Latency, 'f', 0, 64)
@@ -160,116 +878,739 @@ func (r *Results) ToPng() {
 	form.Add("recommendedserverid", strconv.Itoa(r.Server.ID))
 	form.Add("accuracy", "1")
 	form.Add("serverid", strconv.Itoa(r.Server.ID))
+	form.Add("testmethod", "http")
+	form.Add("bytesreceived", strconv.FormatInt(atomic.LoadInt64(&s.bytesReceived), 10))
+	form.Add("bytessent", strconv.FormatInt(atomic.LoadInt64(&s.bytesSent), 10))
 	form.Add("hash", hash)
+	return form
+}
 
-	req, _ := http.NewRequest("POST", "https://www.speedtest.net/api/api.php", strings.NewReader(form.Encode()))
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Referer", "http://c.speedtest.net/flash/speedtest.swf")
-	client := &http.Client{}
-	res, err := client.Do(req)
+// Submit results to speedtest.net, retrying with backoff, and record the URL
+// of the share results image, or the reason submission failed, in Share
+func (r *Results) ToPng() error {
+	s := r.Server.speedtest
+	var resultID string
+	err := s.retry("Share submission", func() error {
+		values, err := s.postResults(shareURL, r.shareForm())
+		if err != nil {
+			return err
+		}
+		resultID = values.Get("resultid")
+		if resultID == "" {
+			return errors.New("no result ID in response")
+		}
+		return nil
+	})
 	if err != nil {
-		r.Share = "Could not submit results to: " + err.Error()
+		r.Share = "Could not submit results: " + err.Error()
+		s.Printf("%s\n", r.Share)
+		return err
 	}
-
-	defer res.Body.Close()
-	resBody, _ := ioutil.ReadAll(res.Body)
-	qsValues, _ := url.ParseQuery(string(resBody))
-	r.Share = fmt.Sprintf("http://www.speedtest.net/result/%s.png", qsValues.Get("resultid"))
-	r.Server.speedtest.Printf("Share results: %s", r.Share)
+	r.Share = fmt.Sprintf("https://www.speedtest.net/result/%s.png", resultID)
+	s.Printf("Share results: %s\n", r.Share)
+	return nil
 }
 
-type Speedtest struct {
-	Configuration *Configuration
-	Servers       *Servers
-	CliFlags      *CliFlags
-	Results       *Results
-	Source        *net.TCPAddr
-	Timeout       time.Duration
+// Submit the signed result form to a self-hosted collector, retrying with
+// backoff
+func (r *Results) Submit(endpoint string) error {
+	s := r.Server.speedtest
+	return s.retry("Result submission", func() error {
+		_, err := s.postResults(endpoint, r.shareForm())
+		return err
+	})
 }
 
-func NewSpeedtest() *Speedtest {
-	return &Speedtest{
-		Configuration: &Configuration{},
-		Servers:       &Servers{},
-		CliFlags:      NewCliFlags(),
-		Results:       NewResults(),
+// Calls fn up to shareAttempts times, doubling the delay between attempts
+func (s *Speedtest) retry(what string, fn func() error) error {
+	var err error
+	delay := shareRetryDelay
+	for attempt := 1; attempt <= shareAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		s.Debugf("%s attempt %d failed: %s", what, attempt, err)
+		if attempt < shareAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
 	}
+	return err
 }
 
-// Printf helper that only prints in "interactive" mode
-func (s *Speedtest) Printf(text string, a ...interface{}) {
-	if !s.CliFlags.Interactive {
-		return
+// Posts a result form to an endpoint, returning the form encoded response
+func (s *Speedtest) postResults(endpoint string, form url.Values) (url.Values, error) {
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// Expected by speedtest.net, and not for self-hosted collectors to see
+	if endpoint == shareURL {
+		req.Header.Set("Referer", "https://www.speedtest.net/")
 	}
 
-	fmt.Printf(text, a...)
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	res, err := s.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected response status %s", res.Status)
+	}
+
+	// Collectors are not required to respond with a form
+	values, _ := url.ParseQuery(string(body))
+	return values, nil
 }
 
-// Fetch Speedtest.net Configuration
-func (s *Speedtest) GetConfiguration() (*Configuration, error) {
-	res, err := http.Get("https://www.speedtest.net/speedtest-config.php")
+// Requests the --ping-url of a dead man's switch service, such as
+// healthchecks.io, with suffix appended to signal a failure
+func (s *Speedtest) PingHealthcheck(suffix string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", strings.TrimSuffix(s.CliFlags.PingURL, "/")+suffix, nil)
 	if err != nil {
-		return s.Configuration, errors.New("Error retrieving Speedtest.net configuration: " + err.Error())
+		return err
 	}
-	defer res.Body.Close()
-	settingsBody, _ := ioutil.ReadAll(res.Body)
-	xml.Unmarshal(settingsBody, &s.Configuration)
-	return s.Configuration, nil
+	res, err := s.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %s", res.Status)
+	}
+	return nil
 }
 
-// Fetch Speedtest.net Servers
-func (s *Speedtest) GetServers(serverId int) (*Servers, error) {
-	res, err := http.Get("https://www.speedtest.net/speedtest-servers.php")
+// Downloads the share results image and writes it to a file
+func (s *Speedtest) SaveShareImage(imageURL, filename string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", imageURL, nil)
 	if err != nil {
-		return s.Servers, errors.New("Error retrieving Speedtest.net servers: " + err.Error())
+		return err
+	}
+	res, err := s.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
 	}
 	defer res.Body.Close()
-	serversBody, _ := ioutil.ReadAll(res.Body)
-	var allServers Servers
-	xml.Unmarshal(serversBody, &allServers)
-	for _, server := range allServers.Servers {
-		server.speedtest = s
-		if serverId == 0 || server.ID == serverId {
-			s.Servers.Servers = append(s.Servers.Servers, server)
-		}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %s", res.Status)
 	}
 
-	return s.Servers, nil
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, res.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-type Client struct {
-	IP        string  `xml:"ip,attr"`
-	ISP       string  `xml:"isp,attr"`
-	Latitude  float64 `xml:"lat,attr"`
-	Longitude float64 `xml:"lon,attr"`
+type Speedtest struct {
+	// Updated atomically, kept first in the struct for 64-bit alignment on
+	// 32-bit platforms
+	bytesSent     int64
+	bytesReceived int64
+
+	Configuration  *Configuration
+	Servers        *Servers
+	CliFlags       *CliFlags
+	Results        *Results
+	Source         *net.TCPAddr
+	Timeout        time.Duration
+	ConnectTimeout time.Duration // Dial timeout, --timeout unless --connect-timeout is set
+	IOTimeout      time.Duration // Longest a test connection read or write may block
+	HTTPClient     *http.Client
+	TLSConfig      *tls.Config
+	QUICClient     *http.Client // HTTP/3 client for --transport quic, nil for TCP
+	Threads        int
+	Interface      string              // Interface used for tests, when --interface-counters is enabled
+	Progress       func(ProgressEvent) // Called every second during the download and upload tests
+
+	// Set by setupTelemetry when --otel is enabled
+	tracePhase    func(name string) func()
+	recordMetrics func(*Results)
+
+	// Pace each direction for --limit-rate, nil when unlimited
+	sendLimit    *rateLimiter
+	receiveLimit *rateLimiter
+
+	// Read buffers shared by test connections, so that connections do not
+	// each allocate a buffer that then has to be garbage collected
+	readBuffers sync.Pool
+
+	// Time taken by the first lookup of each hostname
+	dnsLock  sync.Mutex
+	dnsTimes map[string]time.Duration
 }
 
-type ServerConfig struct {
-	IgnoreIDs   string `xml:"ignoreids,attr"`
-	ThreadCount string `xml:"threadcount,attr"`
+func NewSpeedtest() *Speedtest {
+	s := &Speedtest{
+		Configuration: &Configuration{},
+		Servers:       &Servers{},
+		CliFlags:      NewCliFlags(),
+		Results:       NewResults(),
+		TLSConfig:     &tls.Config{},
+		dnsTimes:      make(map[string]time.Duration),
+	}
+	s.readBuffers.New = func() interface{} {
+		buf := make([]byte, s.CliFlags.ReadBuffer)
+		return &buf
+	}
+	s.HTTPClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			DialContext:     s.dialContext,
+			TLSClientConfig: s.TLSConfig,
+		},
+	}
+	return s
 }
 
-type Times struct {
-	DownloadOne   int `xml:"dl1,attr"`
-	DownloadTwo   int `xml:"dl2,attr"`
-	DownloadThree int `xml:"dl3,attr"`
-	UploadOne     int `xml:"ul1,attr"`
-	UploadTwo     int `xml:"ul2,attr"`
-	UploadThree   int `xml:"ul3,attr"`
+// DialContext for HTTP requests that honors --resolve overrides
+func (s *Speedtest) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: s.ConnectTimeout,
+		Control: s.bindControl,
+	}
+	conn, err := dialer.DialContext(ctx, network, s.CliFlags.Resolve.Lookup(address))
+	if err != nil {
+		return conn, err
+	}
+	return &countingConn{Conn: conn, speedtest: s}, nil
 }
 
-type Download struct {
-	Length       float64 `xml:"testlength,attr"`
-	PacketLength int     `xml:"packetlength,attr"`
+// Records the time taken to resolve a hostname, keeping only the first lookup
+// as later lookups may be answered from a cache
+func (s *Speedtest) recordLookup(host string, elapsed time.Duration) {
+	s.dnsLock.Lock()
+	defer s.dnsLock.Unlock()
+	if _, ok := s.dnsTimes[host]; !ok {
+		s.dnsTimes[host] = elapsed
+		s.Debugf("Resolved %s in %s", host, elapsed)
+	}
 }
 
-type Upload struct {
-	Length       float64 `xml:"testlength,attr"`
-	PacketLength int     `xml:"packetlength,attr"`
+// Returns a context that records the time taken by DNS lookups made by an
+// HTTP request
+func (s *Speedtest) lookupTrace(ctx context.Context) context.Context {
+	var start time.Time
+	var host string
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			host = info.Host
+			start = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err == nil {
+				s.recordLookup(host, time.Since(start))
+			}
+		},
+	})
 }
 
-type Latency struct {
-	Length float64 `xml:"testlength,attr"`
+// Time taken to resolve each of the given hostnames, skipping any that were
+// not resolved with DNS
+func (s *Speedtest) DNSTimings(hosts ...string) []DNSTiming {
+	s.dnsLock.Lock()
+	defer s.dnsLock.Unlock()
+	timings := []DNSTiming{}
+	for _, host := range hosts {
+		if elapsed, ok := s.dnsTimes[host]; ok {
+			timings = append(timings, DNSTiming{
+				Host: host,
+				Time: float64(elapsed.Nanoseconds()) / 1000000.0,
+			})
+		}
+	}
+	return timings
+}
+
+// net.Conn wrapper that tallies the bytes sent and received by the run
+type countingConn struct {
+	net.Conn
+	speedtest *Speedtest
+}
+
+// TLS connection that keeps the connection it runs over, so socket options
+// and statistics can still be read from the TCP connection
+type secureConn struct {
+	*tls.Conn
+	raw net.Conn
+}
+
+// Returns the connection underneath any wrappers added by this package
+func unwrapConn(conn net.Conn) net.Conn {
+	if c, ok := conn.(*secureConn); ok {
+		conn = c.raw
+	}
+	if c, ok := conn.(*countingConn); ok {
+		return c.Conn
+	}
+	return conn
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	limit := c.speedtest.receiveLimit
+	n, err := c.Conn.Read(b[:limit.chunk(len(b))])
+	atomic.AddInt64(&c.speedtest.bytesReceived, int64(n))
+	limit.wait(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	limit := c.speedtest.sendLimit
+	written := 0
+	for written < len(b) {
+		chunk := b[written : written+limit.chunk(len(b)-written)]
+		limit.wait(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		atomic.AddInt64(&c.speedtest.bytesSent, int64(n))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Upper bound of the bytes the download and upload tests may transfer, the
+// actual usage is usually lower as the tests are also limited by time
+func (s *Speedtest) EstimateUsage() (int64, int64) {
+	estimate := func(sizes Sizes) int64 {
+		var total int64
+		for _, size := range sizes {
+			total += int64(size) * requestsPerSize
+		}
+		if max := int64(s.CliFlags.MaxBytes); max > 0 && total > max {
+			return max
+		}
+		return total
+	}
+	var download, upload int64
+	if !s.CliFlags.NoDownload {
+		download = estimate(s.CliFlags.DownloadSizes)
+	}
+	if !s.CliFlags.NoUpload {
+		upload = estimate(s.CliFlags.UploadSizes)
+	}
+	return download, upload
+}
+
+// Apply --insecure and --cacert to the TLS configuration shared by all HTTPS
+// requests and TLS connections
+func (s *Speedtest) ConfigureTLS() error {
+	s.TLSConfig.InsecureSkipVerify = s.CliFlags.Insecure
+	if s.CliFlags.CACert == "" {
+		return nil
+	}
+
+	pem, err := ioutil.ReadFile(s.CliFlags.CACert)
+	if err != nil {
+		return errors.New("Could not read CA bundle: " + err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("No certificates found in CA bundle " + s.CliFlags.CACert)
+	}
+	s.TLSConfig.RootCAs = pool
+	return nil
+}
+
+// Establish a test connection with local address, timeout and socket option
+// support
+func (s *Speedtest) Dial(raddr *net.TCPAddr) (net.Conn, error) {
+	return s.DialContext(context.Background(), raddr)
+}
+
+// Dial with a context that can cancel the connection attempt
+func (s *Speedtest) DialContext(ctx context.Context, raddr *net.TCPAddr) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   s.ConnectTimeout,
+		LocalAddr: s.Source,
+		KeepAlive: s.CliFlags.KeepAlive,
+		Control:   s.control,
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", raddr.String())
+	if err != nil {
+		return conn, err
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if s.CliFlags.Nagle {
+			if err := tcpConn.SetNoDelay(false); err != nil {
+				s.Debugf("Could not enable Nagle's algorithm: %s", err)
+			}
+		}
+		if s.CliFlags.SendBuffer > 0 {
+			if err := tcpConn.SetWriteBuffer(s.CliFlags.SendBuffer); err != nil {
+				s.Debugf("Could not set send buffer size: %s", err)
+			}
+		}
+		if s.CliFlags.RecvBuffer > 0 {
+			if err := tcpConn.SetReadBuffer(s.CliFlags.RecvBuffer); err != nil {
+				s.Debugf("Could not set receive buffer size: %s", err)
+			}
+		}
+	}
+
+	if s.CliFlags.Debug {
+		if sndbuf, rcvbuf, err := socketBufferSizes(conn); err == nil {
+			s.Debugf("Connected to %s with SO_SNDBUF=%d SO_RCVBUF=%d", raddr, sndbuf, rcvbuf)
+		} else {
+			s.Debugf("Connected to %s, could not read socket buffer sizes: %s", raddr, err)
+		}
+	}
+
+	return &countingConn{Conn: conn, speedtest: s}, nil
+}
+
+// Finds the interface that connections to addr leave through, by looking up
+// the local address the OS picks for it
+func (s *Speedtest) FindInterface(addr *net.TCPAddr) (string, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: addr.IP, Port: addr.Port})
+	if err != nil {
+		return "", err
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	if s.Source != nil {
+		local = s.Source.IP
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(local) {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no interface has address %s", local)
+}
+
+// Receive and transmit counters of the test interface, ok is false when
+// counters are disabled or unavailable
+func (s *Speedtest) interfaceSnapshot() (uint64, uint64, bool) {
+	if s.Interface == "" {
+		return 0, 0, false
+	}
+	rx, tx, err := interfaceCounters(s.Interface)
+	if err != nil {
+		s.Debugf("Could not read counters for interface %s: %s", s.Interface, err)
+		return 0, 0, false
+	}
+	return rx, tx, true
+}
+
+// TCP_INFO statistics for a test connection, nil when unavailable
+func (s *Speedtest) tcpStats(conn net.Conn) *TCPStats {
+	stats, err := readTCPStats(conn)
+	if err != nil {
+		s.Debugf("Could not read TCP_INFO: %s", err)
+		return nil
+	}
+	return stats
+}
+
+// Resolves all addresses of a server host, honoring --resolve overrides, and
+// orders them alternating between IPv6 and IPv4 starting with IPv6 as
+// described by RFC 8305. When a source address is set only addresses of its
+// family are returned.
+func (s *Speedtest) ResolveTCPAddrs(hostport string) ([]*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(s.CliFlags.Resolve.Lookup(hostport))
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) == nil {
+		s.recordLookup(host, time.Since(start))
+	}
+
+	var v4, v6 []*net.TCPAddr
+	for _, ip := range ips {
+		addr := &net.TCPAddr{IP: ip.IP, Port: portNum, Zone: ip.Zone}
+		if ip.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	if s.Source != nil {
+		if s.Source.IP.To4() != nil {
+			v6 = nil
+		} else {
+			v4 = nil
+		}
+	}
+
+	var addrs []*net.TCPAddr
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			addrs = append(addrs, v6[i])
+		}
+		if i < len(v4) {
+			addrs = append(addrs, v4[i])
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no usable addresses found for %s", host)
+	}
+	return addrs, nil
+}
+
+// Starts TLS on a test connection, verifying the certificate against
+// serverName unless --insecure is set
+func (s *Speedtest) StartTLS(ctx context.Context, conn net.Conn, serverName string) (net.Conn, error) {
+	config := s.TLSConfig.Clone()
+	config.ServerName = serverName
+	if s.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ConnectTimeout)
+		defer cancel()
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return &secureConn{Conn: tlsConn, raw: conn}, nil
+}
+
+// Races connections to all addresses of a server host, as described by RFC
+// 8305 (Happy Eyeballs), returning the first connection to succeed. Attempts
+// are started connectionAttemptDelay apart, or as soon as the previous
+// attempt fails.
+func (s *Speedtest) DialHappyEyeballs(hostport string) (net.Conn, error) {
+	addrs, err := s.ResolveTCPAddrs(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan attempt, len(addrs))
+
+	var winner net.Conn
+	var firstErr error
+	pending := 0
+	next := 0
+	delay := time.After(0)
+	for winner == nil && (next < len(addrs) || pending > 0) {
+		select {
+		case <-delay:
+			go func(addr *net.TCPAddr) {
+				conn, err := s.DialContext(ctx, addr)
+				results <- attempt{conn, err}
+			}(addrs[next])
+			s.Debugf("Connecting to %s", addrs[next])
+			next++
+			pending++
+			delay = nil
+			if next < len(addrs) {
+				delay = time.After(connectionAttemptDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				winner = r.conn
+			} else if firstErr == nil {
+				firstErr = r.err
+			}
+			// Start the next attempt immediately rather than waiting
+			if r.err != nil && next < len(addrs) {
+				delay = time.After(0)
+			}
+		}
+	}
+
+	// Close connections from attempts that completed after the winner
+	cancel()
+	go func(pending int) {
+		for ; pending > 0; pending-- {
+			if r := <-results; r.err == nil {
+				r.conn.Close()
+			}
+		}
+	}(pending)
+
+	if winner == nil {
+		return nil, firstErr
+	}
+	return winner, nil
+}
+
+// Printf helper that only prints in "interactive" mode
+func (s *Speedtest) Printf(text string, a ...interface{}) {
+	if !s.CliFlags.Interactive {
+		return
+	}
+
+	fmt.Printf(text, a...)
+}
+
+// Marks the start of a phase of the run for tracing, returning a function
+// that marks its end
+func (s *Speedtest) Phase(name string) func() {
+	if s.tracePhase == nil {
+		return func() {}
+	}
+	return s.tracePhase(name)
+}
+
+// Printf helper that only prints when debugging, to stderr so that machine
+// readable output is unaffected
+func (s *Speedtest) Debugf(text string, a ...interface{}) {
+	if !s.CliFlags.Debug {
+		return
+	}
+
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: "+text, a...)
+}
+
+// Fetch Speedtest.net Configuration
+func (s *Speedtest) GetConfiguration() (*Configuration, error) {
+	req, err := http.NewRequest("GET", "https://www.speedtest.net/speedtest-config.php", nil)
+	if err != nil {
+		return s.Configuration, err
+	}
+	res, err := s.HTTPClient.Do(req.WithContext(s.lookupTrace(context.Background())))
+	if err != nil {
+		return s.Configuration, errors.New("Error retrieving Speedtest.net configuration: " + err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s.Configuration, fmt.Errorf("Error retrieving Speedtest.net configuration: %s", res.Status)
+	}
+	settingsBody, _ := ioutil.ReadAll(res.Body)
+	if err := xml.Unmarshal(settingsBody, &s.Configuration); err != nil {
+		return s.Configuration, errors.New("Error parsing Speedtest.net configuration: " + err.Error())
+	}
+	return s.Configuration, nil
+}
+
+// Fetch Speedtest.net Servers
+func (s *Speedtest) GetServers(serverId int) (*Servers, error) {
+	req, err := http.NewRequest("GET", "https://www.speedtest.net/speedtest-servers.php", nil)
+	if err != nil {
+		return s.Servers, err
+	}
+	res, err := s.HTTPClient.Do(req.WithContext(s.lookupTrace(context.Background())))
+	if err != nil {
+		return s.Servers, errors.New("Error retrieving Speedtest.net servers: " + err.Error())
+	}
+	defer res.Body.Close()
+	serversBody, _ := ioutil.ReadAll(res.Body)
+	var allServers Servers
+	if xml.Unmarshal(serversBody, &allServers) == nil && len(allServers.Servers) > 0 {
+		if err := saveServerCache(serversBody); err != nil {
+			s.Debugf("Could not save the server list for completion: %s", err)
+		}
+	}
+	for _, server := range allServers.Servers {
+		server.speedtest = s
+		if serverId == 0 || server.ID == serverId {
+			s.Servers.Servers = append(s.Servers.Servers, server)
+		}
+	}
+
+	return s.Servers, nil
+}
+
+type Client struct {
+	IP        string  `xml:"ip,attr" json:"ip"`
+	ISP       string  `xml:"isp,attr" json:"isp"`
+	Latitude  float64 `xml:"lat,attr,omitempty" json:"lat,omitempty"`
+	Longitude float64 `xml:"lon,attr,omitempty" json:"lon,omitempty"`
+	Country   string  `xml:"country,attr,omitempty" json:"country,omitempty"`
+	ISPRating string  `xml:"isprating,attr,omitempty" json:"isprating,omitempty"`
+	Rating    string  `xml:"rating,attr,omitempty" json:"rating,omitempty"`
+	ISPDLAvg  string  `xml:"ispdlavg,attr,omitempty" json:"ispdlavg,omitempty"`
+	ISPULAvg  string  `xml:"ispulavg,attr,omitempty" json:"ispulavg,omitempty"`
+	LoggedIn  string  `xml:"loggedin,attr,omitempty" json:"loggedin,omitempty"`
+}
+
+type ServerConfig struct {
+	IgnoreIDs   string `xml:"ignoreids,attr"`
+	ThreadCount string `xml:"threadcount,attr"`
+}
+
+// Thread count advertised by the configuration, or the default when missing or
+// invalid
+func (c ServerConfig) Threads() int {
+	threads, err := strconv.Atoi(c.ThreadCount)
+	if err != nil || threads < 1 {
+		return defaultThreads
+	}
+	return threads
+}
+
+// Fills in the test lengths missing from the configuration with the built in
+// defaults, such as when the configuration could not be retrieved
+func (c *Configuration) ApplyDefaults() {
+	if c.Download.Length <= 0 {
+		c.Download.Length = defaultDownloadLength
+	}
+	if c.Upload.Length <= 0 {
+		c.Upload.Length = defaultUploadLength
+	}
+}
+
+type Times struct {
+	DownloadOne   int `xml:"dl1,attr"`
+	DownloadTwo   int `xml:"dl2,attr"`
+	DownloadThree int `xml:"dl3,attr"`
+	UploadOne     int `xml:"ul1,attr"`
+	UploadTwo     int `xml:"ul2,attr"`
+	UploadThree   int `xml:"ul3,attr"`
+}
+
+type Download struct {
+	Length       float64 `xml:"testlength,attr"`
+	PacketLength int     `xml:"packetlength,attr"`
+}
+
+type Upload struct {
+	Length       float64 `xml:"testlength,attr"`
+	PacketLength int     `xml:"packetlength,attr"`
+}
+
+type Latency struct {
+	Length float64 `xml:"testlength,attr"`
 }
 
 type Configuration struct {
@@ -296,6 +1637,56 @@ type Server struct {
 	Latency   time.Duration `xml:"latency,attr" json:"latency"`
 	speedtest *Speedtest
 	tcpAddr   *net.TCPAddr
+
+	latencySamples []time.Duration
+	latencyMethod  string
+
+	// Whether the server accepted TLS on the test port, with --secure
+	secure bool
+
+	pool *connPool
+}
+
+// Dials a test connection to the selected server, over TLS when the server
+// accepted it during latency testing
+func (s *Server) dial() (net.Conn, error) {
+	conn, err := s.speedtest.Dial(s.tcpAddr)
+	if err != nil || !s.secure {
+		return conn, err
+	}
+	host, _, _ := net.SplitHostPort(s.Host)
+	secure, err := s.speedtest.StartTLS(context.Background(), conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return secure, nil
+}
+
+// Minimum, maximum and standard deviation of the latency samples in ms
+func (s *Server) LatencyStats() (float64, float64, float64) {
+	if len(s.latencySamples) == 0 {
+		return 0, 0, 0
+	}
+	min, max := s.latencySamples[0], s.latencySamples[0]
+	for _, sample := range s.latencySamples {
+		if sample < min {
+			min = sample
+		}
+		if sample > max {
+			max = sample
+		}
+	}
+
+	mean := s.Latency.Seconds() * 1000
+	var variance float64
+	for _, sample := range s.latencySamples {
+		diff := sample.Seconds()*1000 - mean
+		variance += diff * diff
+	}
+	variance /= float64(len(s.latencySamples))
+
+	return min.Seconds() * 1000, max.Seconds() * 1000, math.Sqrt(variance)
 }
 
 type Servers struct {
@@ -310,7 +1701,9 @@ func (s *Servers) SortServersByDistance() {
 			return s1.Distance < s2.Distance
 		},
 	}
-	sort.Sort(ps)
+	// Stable, so servers keep the order of the server list when distances
+	// are unknown
+	sort.Stable(ps)
 }
 
 // Sort is a method on the function type, By, that sorts the argument slice according to the function.
@@ -359,124 +1752,748 @@ func (s *Servers) SetDistances(latitude, longitude float64) {
 	}
 }
 
-// Tests the 5 closest servers latency, and returns the server with lowest latency
-func (s *Servers) TestLatency() *Server {
-	var servers []Server
-	s.SortServersByDistance()
-
-	if len(s.Servers) >= 5 {
-		servers = s.Servers[:5]
-	} else {
-		servers = s.Servers[:len(s.Servers)]
-	}
-
-	for i, server := range servers {
-		addr, err := net.ResolveTCPAddr("tcp", server.Host)
-		s.Servers[i].tcpAddr = addr
-		if err != nil {
-			server.speedtest.Printf("%s\n", err.Error())
-			continue
-		}
-
-		conn, err := dialTimeout("tcp", server.speedtest.Source, addr, server.speedtest.Timeout)
-		if err != nil {
-			server.speedtest.Printf("%s\n", err.Error())
-			continue
+// Tests the latency of the servers in the pool in order, returning the first
+// that responds, or nil when none do
+func (s *Servers) SelectPool(pool []int) *Server {
+	for _, id := range pool {
+		for i := range s.Servers {
+			if s.Servers[i].ID != id {
+				continue
+			}
+			s.Servers[i].testLatency()
+			if s.Servers[i].Latency > 0 {
+				return &s.Servers[i]
+			}
+			s.Servers[i].speedtest.Debugf("Pool server %d did not respond", id)
 		}
+	}
+	return nil
+}
 
-		defer conn.Close()
-
-		conn.Write([]byte("HI\n"))
-		hello := make([]byte, 1024)
-		conn.Read(hello)
-
-		sum := time.Duration(0)
-		for j := 0; j < 3; j++ {
-			resp := make([]byte, 1024)
-			start := time.Now()
-			conn.Write([]byte(fmt.Sprintf("PING %d\n", start.UnixNano()/1000000)))
-			conn.Read(resp)
-			total := time.Since(start)
-			sum += total
+// Removes the servers with the given IDs
+func (s *Servers) Exclude(ids ServerIDs) {
+	if len(ids) == 0 {
+		return
+	}
+	kept := s.Servers[:0]
+	for _, server := range s.Servers {
+		if !ids[server.ID] {
+			kept = append(kept, server)
 		}
-		s.Servers[i].Latency = sum / 3
 	}
+	s.Servers = kept
+}
+
+// Tests the latency of the given number of closest servers, and returns the
+// server with lowest latency
+func (s *Servers) TestLatency(candidates int) *Server {
+	s.probeLatency(candidates)
 	s.SortServersByLatency()
 	return &s.Servers[0]
 }
 
-// Goroutine for downloading data
-func (s *Server) Downloader(ci chan int, co chan []int, wg *sync.WaitGroup, start time.Time, length float64) {
-	defer wg.Done()
+// Tests the latency of the given number of closest servers, leaving the
+// servers sorted by distance. When none of them respond, such as during a
+// transient outage, the next closest are tried, up to latencyTranches times.
+// Returns the servers probed.
+func (s *Servers) probeLatency(candidates int) []Server {
+	s.SortServersByDistance()
 
-	conn, err := dialTimeout("tcp", s.speedtest.Source, s.tcpAddr, s.speedtest.Timeout)
-	if err != nil {
-		errorf("\nCannot connect to %s\n", s.tcpAddr.String())
+	start := 0
+	for tranche := 0; tranche < latencyTranches && start < len(s.Servers); tranche++ {
+		end := start + candidates
+		if end > len(s.Servers) {
+			end = len(s.Servers)
+		}
+		if tranche > 0 {
+			s.Servers[start].speedtest.Printf("No servers responded, trying the next %d closest...\n", end-start)
+		}
+		s.probeRange(start, end)
+		for i := start; i < end; i++ {
+			if s.Servers[i].Latency > 0 {
+				return s.Servers[:end]
+			}
+		}
+		start = end
+	}
+	return s.Servers[:start]
+}
+
+// Tests the latency of the servers from start to end concurrently, with a
+// bounded number of workers
+func (s *Servers) probeRange(start, end int) {
+	jobs := make(chan int)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < latencyWorkers && w < end-start; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				s.Servers[i].testLatency()
+			}
+		}()
+	}
+	for i := start; i < end; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// Chooses the server to test against from the available servers. Selectors
+// consider the given number of closest candidates and, when none of them
+// respond, the next closest as many at a time, up to latencyTranches times.
+type ServerSelector interface {
+	Select(servers *Servers, candidates int) *Server
+}
+
+// Selects the candidate with the lowest latency
+type LatencySelector struct{}
+
+func (LatencySelector) Select(servers *Servers, candidates int) *Server {
+	return servers.TestLatency(candidates)
+}
+
+// Selects the closest server that responds, testing the latency of the
+// candidates one at a time, closest first, so usually only one is tested
+type DistanceSelector struct{}
+
+func (DistanceSelector) Select(servers *Servers, candidates int) *Server {
+	servers.SortServersByDistance()
+	for i := 0; i < candidates*latencyTranches && i < len(servers.Servers); i++ {
+		servers.Servers[i].testLatency()
+		if servers.Servers[i].Latency > 0 {
+			return &servers.Servers[i]
+		}
+	}
+	return &servers.Servers[0]
+}
+
+// Selects the candidate with the lowest latency once a penalty proportional
+// to its distance has been added, favouring nearby servers when latencies
+// are close
+type HybridSelector struct {
+	// Milliseconds of latency added per kilometre of distance
+	DistanceWeight float64
+}
+
+func (h HybridSelector) Select(servers *Servers, candidates int) *Server {
+	var best *Server
+	var bestScore float64
+	probed := servers.probeLatency(candidates)
+	for i := range probed {
+		server := &probed[i]
+		// Latency should never be 0 unless the latency test failed
+		if server.Latency == 0 {
+			continue
+		}
+		score := server.Latency.Seconds()*1000 + server.Distance*h.DistanceWeight
+		if best == nil || score < bestScore {
+			best, bestScore = server, score
+		}
+	}
+	if best == nil {
+		return &servers.Servers[0]
 	}
+	return best
+}
+
+// Server selection strategies available with the --select flag
+var serverSelectors = map[string]ServerSelector{
+	"latency":  LatencySelector{},
+	"distance": DistanceSelector{},
+	// Roughly the round trip time of light in fibre
+	"hybrid": HybridSelector{DistanceWeight: 0.01},
+}
+
+// Measures latency with the speedtest socket protocol, falling back to HTTP
+// and then ICMP when the server's test port is unreachable
+func (s *Server) testLatency() {
+	err := s.testLatencyTCP()
+	if err == nil {
+		return
+	}
+	s.speedtest.Printf("%s\n", err.Error())
+
+	if err = s.testLatencyHTTP(); err == nil {
+		return
+	}
+	s.speedtest.Debugf("HTTP latency test to %s failed: %s", s.Host, err)
+
+	if err = s.testLatencyICMP(); err != nil {
+		s.speedtest.Debugf("ICMP latency test to %s failed: %s", s.Host, err)
+	}
+}
 
+// Records latency samples and the method used to take them
+func (s *Server) setLatency(samples []time.Duration, method string) {
+	sum := time.Duration(0)
+	for _, sample := range samples {
+		sum += sample
+	}
+	s.Latency = sum / time.Duration(len(samples))
+	s.latencySamples = samples
+	s.latencyMethod = method
+}
+
+// Measures latency with PING requests over the speedtest socket protocol
+func (s *Server) testLatencyTCP() error {
+	conn, err := s.speedtest.DialHappyEyeballs(s.Host)
+	if err != nil {
+		return err
+	}
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+
+	// Prefer TLS with --secure, falling back to plaintext when the server
+	// does not accept it on the test port
+	secure := false
+	if s.speedtest.CliFlags.Secure {
+		host, _, _ := net.SplitHostPort(s.Host)
+		if tlsConn, err := s.speedtest.StartTLS(context.Background(), conn, host); err == nil {
+			conn = tlsConn
+			secure = true
+		} else {
+			s.speedtest.Debugf("Server %d does not accept TLS, using plaintext: %s", s.ID, err)
+			conn.Close()
+			if conn, err = s.speedtest.Dial(addr); err != nil {
+				return err
+			}
+		}
+	}
 	defer conn.Close()
 
+	// Bound the whole probe so an unresponsive server cannot stall selection
+	conn.SetDeadline(time.Now().Add(s.speedtest.Timeout))
+
 	conn.Write([]byte("HI\n"))
 	hello := make([]byte, 1024)
-	conn.Read(hello)
-	var ask int
-	tmp := make([]byte, 1024)
+	if _, err := conn.Read(hello); err != nil {
+		return err
+	}
+
+	count := s.speedtest.CliFlags.PingCount
+	samples := make([]time.Duration, 0, count)
+	for j := 0; j < count; j++ {
+		resp := make([]byte, 1024)
+		start := time.Now()
+		conn.Write([]byte(fmt.Sprintf("PING %d\n", start.UnixNano()/1000000)))
+		if _, err := conn.Read(resp); err != nil {
+			return err
+		}
+		samples = append(samples, time.Since(start))
+	}
+	s.tcpAddr = addr
+	s.secure = secure
+	s.setLatency(samples, "tcp")
+	return nil
+}
+
+// Measures latency with HTTP requests for latency.txt alongside the server's
+// upload URL, as the legacy HTTP based clients did
+func (s *Server) testLatencyHTTP() error {
+	addrs, err := s.speedtest.ResolveTCPAddrs(s.Host)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(path.Dir(u.Path), "latency.txt")
+
+	// Bound the whole probe so an unresponsive server cannot stall selection
+	ctx, cancel := context.WithTimeout(context.Background(), s.speedtest.Timeout)
+	defer cancel()
+
+	count := s.speedtest.CliFlags.PingCount
+	samples := make([]time.Duration, 0, count)
+	for j := 0; j < count; j++ {
+		// Defeat any caching between us and the server
+		u.RawQuery = "x=" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		res, err := s.speedtest.HTTPClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "test=test") {
+			return fmt.Errorf("unexpected response from %s", u)
+		}
+		samples = append(samples, time.Since(start))
+	}
+
+	s.tcpAddr = addrs[0]
+	s.setLatency(samples, "http")
+	return nil
+}
+
+// Measures latency with ICMP echo requests, so that server selection still
+// works when neither the test port nor HTTP are reachable
+func (s *Server) testLatencyICMP() error {
+	addrs, err := s.speedtest.ResolveTCPAddrs(s.Host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		samples, err := s.speedtest.PingICMP(addr.IP, s.speedtest.CliFlags.PingCount)
+		if err != nil {
+			s.speedtest.Debugf("ICMP latency test to %s failed: %s", addr.IP, err)
+			continue
+		}
+		s.tcpAddr = addr
+		s.setLatency(samples, "icmp")
+		return nil
+	}
+	return errors.New("no ICMP echo replies received")
+}
+
+// Outcome of a download or upload test
+type Transfer struct {
+	Bytes    int64
+	Duration time.Duration
+	Samples  []float64 // Throughput in bits/s for each second of the test
+	CPUUsage float64   // Fraction of all available CPUs used during the test
+
+	// Bytes received (download) or sent (upload) by the test interface as
+	// observed by the OS, 0 unless --interface-counters is enabled
+	InterfaceBytes uint64
+
+	Connections []ConnectionStats
+}
+
+// Bytes and throughput in bits/s of a single test connection
+type ConnectionStats struct {
+	Bytes int64     `json:"bytes" xml:"bytes"`
+	Rate  float64   `json:"rate" xml:"rate"`
+	TCP   *TCPStats `json:"tcp,omitempty" xml:"tcp,omitempty"`
+}
+
+// TCP level statistics of test connections, from TCP_INFO
+type TCPStats struct {
+	Retransmits  uint32  `json:"retransmits" xml:"retransmits"`
+	RTT          float64 `json:"rtt" xml:"rtt"`                     // Smoothed RTT in ms
+	RTTVar       float64 `json:"rtt_var" xml:"rtt_var"`             // RTT variance in ms
+	DeliveryRate float64 `json:"delivery_rate" xml:"delivery_rate"` // Most recent delivery rate in bits/s
+}
+
+// Effective path MTU and TCP maximum segment size to the selected server
+type PathMTU struct {
+	MTU     int  `json:"mtu" xml:"mtu"`
+	MSS     int  `json:"mss" xml:"mss"`
+	Reduced bool `json:"reduced" xml:"reduced"` // Below standardMTU, or the MSS is clamped below the MTU
+}
+
+// Sends enough data to the server for path MTU discovery to take effect, then
+// reads the path MTU and maximum segment size learned by the kernel
+func (s *Server) ProbePathMTU() (*PathMTU, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.speedtest.Timeout))
+
+	resp := make([]byte, 1024)
+	conn.Write([]byte("HI\n"))
+	if _, err := conn.Read(resp); err != nil {
+		return nil, err
+	}
+
+	header := []byte(fmt.Sprintf("UPLOAD %d 0\n", uploadChunkSize))
+	conn.Write(header)
+	conn.Write(uploadPayload()[:uploadChunkSize-len(header)])
+	if _, err := conn.Read(resp); err != nil {
+		return nil, err
+	}
+
+	mtu, mss, err := pathMTU(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// IPv4 and TCP headers take 40 bytes, IPv6 and TCP headers 60 bytes
+	overhead := 40
+	if s.tcpAddr.IP.To4() == nil {
+		overhead = 60
+	}
+	return &PathMTU{
+		MTU:     mtu,
+		MSS:     mss,
+		Reduced: mtu < standardMTU || mss < mtu-overhead-tcpOptionsSize,
+	}, nil
+}
+
+// Combined TCP statistics of all connections of a test, retransmits and
+// delivery rates are summed and RTTs averaged. Returns nil when TCP_INFO was
+// unavailable.
+func (t *Transfer) TCPStats() *TCPStats {
+	var total TCPStats
+	count := 0
+	for _, c := range t.Connections {
+		if c.TCP == nil {
+			continue
+		}
+		total.Retransmits += c.TCP.Retransmits
+		total.RTT += c.TCP.RTT
+		total.RTTVar += c.TCP.RTTVar
+		total.DeliveryRate += c.TCP.DeliveryRate
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+	total.RTT /= float64(count)
+	total.RTTVar /= float64(count)
+	return &total
+}
+
+// Whether throughput differed widely between connections, with the slowest
+// below imbalanceThreshold of the average. This usually indicates per flow
+// policing.
+func (t *Transfer) Imbalanced() bool {
+	if len(t.Connections) < 2 {
+		return false
+	}
+	var sum float64
+	slowest := math.Inf(1)
+	for _, c := range t.Connections {
+		sum += c.Rate
+		slowest = math.Min(slowest, c.Rate)
+	}
+	mean := sum / float64(len(t.Connections))
+	return mean > 0 && slowest < mean*imbalanceThreshold
+}
+
+// Whether the test was likely limited by CPU rather than the link
+func (t *Transfer) CPUSaturated() bool {
+	return t.CPUUsage >= cpuSaturationThreshold
+}
+
+// Fraction of all available CPUs used by the process since start, or 0 when
+// process CPU time is unavailable
+func cpuUsage(cpuStart time.Duration, start time.Time) float64 {
+	cpuEnd, err := processCPUTime()
+	if err != nil {
+		return 0
+	}
+	wall := time.Since(start).Seconds() * float64(runtime.NumCPU())
+	return (cpuEnd - cpuStart).Seconds() / wall
+}
+
+// Throughput of the test in bits/s
+func (t *Transfer) Rate() float64 {
+	return float64(t.Bytes) * 8 / t.Duration.Seconds()
+}
+
+// State shared by the workers of a download or upload test
+type transferState struct {
+	// Updated atomically, kept first in the struct for 64-bit alignment on
+	// 32-bit platforms
+	bytes     int64
+	rampBytes int64 // Bytes transferred during the ramp, not measured
+	firstByte int64 // UnixNano of the first byte sent or received, 0 until then
+
+	start   time.Time
+	length  time.Duration
+	ramp    time.Duration // Time after the first byte before measuring starts
+	workers []int64       // Bytes transferred by each worker, updated atomically
+	tcp     []*TCPStats   // TCP_INFO of each worker's connection at its end
+}
+
+func newTransferState(length float64, ramp time.Duration, threads int) *transferState {
+	return &transferState{
+		start:   time.Now(),
+		length:  time.Duration(length * float64(time.Second)),
+		ramp:    ramp,
+		workers: make([]int64, threads),
+		tcp:     make([]*TCPStats, threads),
+	}
+}
+
+// Opens the measurement window if it is not already open
+func (t *transferState) open() {
+	atomic.CompareAndSwapInt64(&t.firstByte, 0, time.Now().UnixNano())
+}
+
+// Records bytes transferred by a worker, the first call opens the
+// measurement window. Bytes transferred during the ramp are not measured.
+func (t *transferState) add(worker, n int) {
+	if n <= 0 {
+		return
+	}
+	t.open()
+	if t.ramp > 0 && time.Now().Before(t.measureStart()) {
+		atomic.AddInt64(&t.rampBytes, int64(n))
+		return
+	}
+	atomic.AddInt64(&t.bytes, int64(n))
+	atomic.AddInt64(&t.workers[worker], int64(n))
+}
+
+// Per connection statistics over a measurement window
+func (t *transferState) connections(window time.Duration) []ConnectionStats {
+	stats := make([]ConnectionStats, len(t.workers))
+	for i := range t.workers {
+		bytes := atomic.LoadInt64(&t.workers[i])
+		stats[i] = ConnectionStats{
+			Bytes: bytes,
+			Rate:  float64(bytes) * 8 / window.Seconds(),
+			TCP:   t.tcp[i],
+		}
+	}
+	return stats
+}
+
+// Bytes measured, excluding the ramp
+func (t *transferState) transferred() int64 {
+	return atomic.LoadInt64(&t.bytes)
+}
+
+// Bytes transferred, including the ramp
+func (t *transferState) total() int64 {
+	return atomic.LoadInt64(&t.bytes) + atomic.LoadInt64(&t.rampBytes)
+}
+
+// Start of measuring, once the ramp after the first byte is over
+func (t *transferState) measureStart() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.firstByte)).Add(t.ramp)
+}
+
+// End of the measurement window, which lasts length from the end of the ramp
+// after the first byte transferred. Until the first byte arrives the window
+// is not yet open.
+func (t *transferState) deadline() (time.Time, bool) {
+	if atomic.LoadInt64(&t.firstByte) == 0 {
+		return time.Time{}, false
+	}
+	return t.measureStart().Add(t.length), true
+}
+
+// Whether workers should stop issuing requests
+func (t *transferState) done() bool {
+	if deadline, ok := t.deadline(); ok {
+		return !time.Now().Before(deadline)
+	}
+	// Give up if no data has arrived within the test length
+	return time.Since(t.start) >= t.length
+}
+
+// Duration of the measurement window, from the end of the ramp until the
+// deadline or end, whichever came first. A test that ended during the ramp
+// measured nothing, its window is the time since the first byte.
+func (t *transferState) window(end time.Time) time.Duration {
+	deadline, ok := t.deadline()
+	if !ok {
+		return end.Sub(t.start)
+	}
+	if end.After(deadline) {
+		end = deadline
+	}
+	if !end.After(t.measureStart()) {
+		return end.Sub(time.Unix(0, atomic.LoadInt64(&t.firstByte)))
+	}
+	return end.Sub(t.measureStart())
+}
+
+// Start, throughput while running, or end of a download or upload test
+type ProgressEvent struct {
+	Type    string  `json:"type"`    // start, progress or end
+	Phase   string  `json:"phase"`   // download or upload
+	Elapsed float64 `json:"elapsed"` // Seconds since the test started
+	Bytes   int64   `json:"bytes"`   // Bytes transferred so far
+	Rate    float64 `json:"rate"`    // Throughput over the last interval, or of the whole test at its end, in bits/s
+}
+
+// Writes a progress event to stdout as a JSON line for --progress json
+func writeProgressJSON(event ProgressEvent) {
+	line, _ := json.Marshal(event)
+	fmt.Printf("%s\n", line)
+}
+
+// Reports a progress event when progress reporting is enabled
+func (s *Speedtest) progress(event ProgressEvent) {
+	if s.Progress != nil {
+		s.Progress(event)
+	}
+}
+
+// Reports the end of a download or upload test
+func (s *Speedtest) progressEnd(phase string, state *transferState, transfer *Transfer) {
+	s.progress(ProgressEvent{
+		Type:    "end",
+		Phase:   phase,
+		Elapsed: time.Since(state.start).Seconds(),
+		Bytes:   transfer.Bytes,
+		Rate:    transfer.Rate(),
+	})
+}
+
+// Samples the throughput of a test every interval from its shared byte
+// counter, until stop is closed, reporting each sample as progress
+func (s *Server) sampleRate(phase string, state *transferState, interval time.Duration, stop chan struct{}, out chan []float64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var samples []float64
+	var last int64
+	start := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			current := state.total()
+			rate := float64(current-last) * 8 / interval.Seconds()
+			samples = append(samples, rate)
+			last = current
+			s.speedtest.progress(ProgressEvent{
+				Type:    "progress",
+				Phase:   phase,
+				Elapsed: time.Since(start).Seconds(),
+				Bytes:   current,
+				Rate:    rate,
+			})
+		case <-stop:
+			out <- samples
+			return
+		}
+	}
+}
+
+// Deadline for the next read or write of a test connection, the end of the
+// measurement window or --io-timeout from now, whichever comes first. Zero,
+// no deadline, when neither applies yet.
+func (s *Server) ioDeadline(state *transferState) time.Time {
+	var deadline time.Time
+	if s.speedtest.IOTimeout > 0 {
+		deadline = time.Now().Add(s.speedtest.IOTimeout)
+	}
+	if end, ok := state.deadline(); ok && (deadline.IsZero() || end.Before(deadline)) {
+		return end
+	}
+	return deadline
+}
+
+// Whether an error on a test connection is a timeout while the measurement
+// window is still open, meaning the server stopped responding
+func (s *Server) stalled(phase string, worker int, state *transferState, err error) bool {
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() || state.done() {
+		return false
+	}
+	s.speedtest.Debugf("%s connection %d stalled for %s, aborting it", phase, worker, s.speedtest.IOTimeout)
+	return true
+}
+
+// Whether the --max-bytes budget for a test has been used up
+func (s *Server) budgetExhausted(state *transferState) bool {
+	max := int64(s.speedtest.CliFlags.MaxBytes)
+	return max > 0 && state.total() >= max
+}
+
+// Goroutine for downloading data
+func (s *Server) Downloader(ci chan int, wg *sync.WaitGroup, state *transferState, worker int) {
+	defer wg.Done()
+
+	bufp := s.speedtest.readBuffers.Get().(*[]byte)
+	defer s.speedtest.readBuffers.Put(bufp)
+	tmp := *bufp
+
+	conn, err := s.workerConn(worker, tmp)
+	if err != nil {
+		errorf("\nCannot connect to %s\n", s.tcpAddr.String())
+	}
 
-	var out []int
+	var ask, pending int
+	request := make([]byte, 0, 32)
+	reusable := true
+	aborted := false // Keeps consuming sizes without testing once set
 
 	for size := range ci {
 		s.speedtest.Printf(".")
 		remaining := size
 
-		for remaining > 0 && time.Since(start).Seconds() < length {
+		for remaining > 0 && !aborted && !state.done() && !s.budgetExhausted(state) {
 
-			if remaining > 1000000 {
-				ask = 1000000
+			if remaining > int(s.speedtest.CliFlags.DownloadChunk) {
+				ask = int(s.speedtest.CliFlags.DownloadChunk)
 			} else {
 				ask = remaining
 			}
 			down := 0
 
-			conn.Write([]byte(fmt.Sprintf("DOWNLOAD %d\n", ask)))
+			request = append(strconv.AppendInt(append(request[:0], "DOWNLOAD "...), int64(ask), 10), '\n')
+			conn.SetWriteDeadline(s.ioDeadline(state))
+			if _, err := conn.Write(request); err != nil {
+				s.stalled("Download", worker, state, err)
+				reusable, aborted = false, true
+				break
+			}
 
 			for down < ask {
+				// Data arriving after the measurement window closes is not
+				// counted, stop reading as soon as it does
+				conn.SetReadDeadline(s.ioDeadline(state))
 				n, err := conn.Read(tmp)
+				state.add(worker, n)
+				down += n
 				if err != nil {
-					if err != io.EOF {
+					netErr, ok := err.(net.Error)
+					timeout := ok && netErr.Timeout()
+					if s.stalled("Download", worker, state, err) {
+						aborted = true
+					} else if err != io.EOF && !timeout {
 						fmt.Printf("ERR: %v\n", err)
 					}
+					if !timeout || aborted {
+						reusable = false
+					}
 					break
 				}
-				down += n
 			}
-			out = append(out, down)
+			pending = ask - down
 			remaining -= down
 
 		}
 		s.speedtest.Printf(".")
 	}
 
-	go func(co chan []int, out []int) {
-		co <- out
-	}(co, out)
-
+	state.tcp[worker] = s.connStats(worker, conn)
+	s.releaseConn(worker, conn, reusable && drainDownload(conn, pending, tmp))
 }
 
 // Function that controls Downloader goroutine
-func (s *Server) TestDownload(length float64) (float64, time.Duration) {
+func (s *Server) TestDownload(length float64) *Transfer {
+	if s.speedtest.QUICClient != nil {
+		return s.testQUIC("download", s.speedtest.CliFlags.DownloadSizes, length)
+	}
 	ci := make(chan int)
-	co := make(chan []int)
 	wg := new(sync.WaitGroup)
-	sizes := []int{245388, 505544, 1118012, 1986284, 4468241, 7907740, 12407926, 17816816, 24262167, 31625365}
-	start := time.Now()
+	sizes := s.speedtest.CliFlags.DownloadSizes
+	s.initPool()
+	state := newTransferState(length, s.speedtest.CliFlags.Ramp, s.speedtest.Threads)
 
-	for i := 0; i < 8; i++ {
+	cpuStart, _ := processCPUTime()
+	rxStart, _, ifOK := s.speedtest.interfaceSnapshot()
+
+	for i := 0; i < s.speedtest.Threads; i++ {
 		wg.Add(1)
-		go s.Downloader(ci, co, wg, start, length)
+		go s.Downloader(ci, wg, state, i)
 	}
 
+	stop := make(chan struct{})
+	samples := make(chan []float64)
+	s.speedtest.progress(ProgressEvent{Type: "start", Phase: "download"})
+	go s.sampleRate("download", state, time.Second, stop, samples)
+
 	for _, size := range sizes {
-		for i := 0; i < 4; i++ {
+		for i := 0; i < requestsPerSize; i++ {
 			ci <- size
 		}
 	}
@@ -484,83 +2501,155 @@ func (s *Server) TestDownload(length float64) (float64, time.Duration) {
 	close(ci)
 	wg.Wait()
 
-	total := time.Since(start)
+	total := state.window(time.Now())
+	close(stop)
 	s.speedtest.Printf("\n")
 
-	var totalSize int
-	for i := 0; i < 8; i++ {
-		chunks := <-co
-		for _, chunk := range chunks {
-			totalSize += chunk
-		}
+	transfer := &Transfer{
+		Bytes:    state.transferred(),
+		Duration: total,
+		Samples:  <-samples,
+		CPUUsage: cpuUsage(cpuStart, state.start),
 	}
-
-	return float64(totalSize) * 8, total
+	transfer.Connections = state.connections(total)
+	if rxEnd, _, ok := s.speedtest.interfaceSnapshot(); ok && ifOK {
+		transfer.InterfaceBytes = rxEnd - rxStart
+	}
+	s.speedtest.progressEnd("download", state, transfer)
+	return transfer
 }
 
 // Goroutine for uploading data
-func (s *Server) Uploader(ci chan int, co chan []int, wg *sync.WaitGroup, start time.Time, length float64) {
+func (s *Server) Uploader(ci chan int, wg *sync.WaitGroup, state *transferState, worker int) {
 	defer wg.Done()
 
-	conn, err := dialTimeout("tcp", s.speedtest.Source, s.tcpAddr, s.speedtest.Timeout)
+	bufp := s.speedtest.readBuffers.Get().(*[]byte)
+	defer s.speedtest.readBuffers.Put(bufp)
+	tmp := *bufp
+
+	conn, err := s.workerConn(worker, tmp)
 	if err != nil {
 		errorf("\nCannot connect to %s\n", s.tcpAddr.String())
 	}
 
-	defer conn.Close()
-
-	conn.Write([]byte("HI\n"))
-	hello := make([]byte, 1024)
-	conn.Read(hello)
-
 	var give int
-	var out []int
+	header := make([]byte, 0, 32)
+	reusable := true
+	awaiting := false // Whether the response to the last request is still outstanding
+	aborted := false  // Keeps consuming sizes without testing once set
 	for size := range ci {
 		s.speedtest.Printf(".")
 		remaining := size
 
-		for remaining > 0 && time.Since(start).Seconds() < length {
-			if remaining > 100000 {
-				give = 100000
+		for remaining > 0 && !aborted && !state.done() && !s.budgetExhausted(state) {
+			if remaining > int(s.speedtest.CliFlags.UploadChunk) {
+				give = int(s.speedtest.CliFlags.UploadChunk)
 			} else {
 				give = remaining
 			}
-			header := []byte(fmt.Sprintf("UPLOAD %d 0\n", give))
-			data := make([]byte, give-len(header))
-
-			conn.Write(header)
-			conn.Write(data)
-			up := make([]byte, 24)
-			conn.Read(up)
+			// The request must at least be large enough to hold its own header
+			if give < 32 {
+				give = 32
+			}
+			header = append(strconv.AppendInt(append(header[:0], "UPLOAD "...), int64(give), 10), " 0\n"...)
+			data := uploadPayload()[:give-len(header)]
+
+			// The window opens when the first request is sent, data is only
+			// counted once the server acknowledges receiving it, and nothing
+			// acknowledged after the window closes is counted
+			state.open()
+
+			// A request only partially written leaves the connection unusable
+			conn.SetWriteDeadline(s.ioDeadline(state))
+			if _, err := conn.Write(header); err != nil {
+				s.stalled("Upload", worker, state, err)
+				reusable, aborted = false, true
+				break
+			}
+			conn.SetWriteDeadline(s.ioDeadline(state))
+			if _, err := conn.Write(data); err != nil {
+				s.stalled("Upload", worker, state, err)
+				reusable, aborted = false, true
+				break
+			}
+			conn.SetReadDeadline(s.ioDeadline(state))
+			n, err := conn.Read(tmp)
+			if err != nil {
+				if s.stalled("Upload", worker, state, err) {
+					reusable, aborted = false, true
+				} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					awaiting = true
+				} else {
+					reusable = false
+				}
+				break
+			}
 
-			out = append(out, give)
+			state.add(worker, s.uploadAcknowledged(tmp[:n], give))
 			remaining -= give
 		}
 		s.speedtest.Printf(".")
 	}
 
-	go func(co chan []int, out []int) {
-		co <- out
-	}(co, out)
+	state.tcp[worker] = s.connStats(worker, conn)
+	s.releaseConn(worker, conn, reusable && (!awaiting || drainUpload(conn, tmp)))
+}
+
+// Number of bytes acknowledged by an "OK <size> <time>" response to an UPLOAD
+// request, falling back to the size sent if the response cannot be parsed
+func (s *Server) uploadAcknowledged(response []byte, sent int) int {
+	fields := strings.Fields(string(response))
+	if len(fields) >= 2 && fields[0] == "OK" {
+		if size, err := strconv.Atoi(fields[1]); err == nil {
+			return size
+		}
+	}
+	s.speedtest.Debugf("Unexpected UPLOAD response: %q", response)
+	return sent
+}
+
+var (
+	payload     []byte
+	payloadOnce sync.Once
+)
 
+// Pseudorandom upload data, generated once and shared by all uploaders, so
+// that compressing middleboxes cannot inflate upload results
+func uploadPayload() []byte {
+	payloadOnce.Do(func() {
+		payload = make([]byte, maxUploadChunkSize)
+		rand.New(rand.NewSource(time.Now().UnixNano())).Read(payload)
+	})
+	return payload
 }
 
 // Function that controls Uploader goroutine
-func (s *Server) TestUpload(length float64) (float64, time.Duration) {
+func (s *Server) TestUpload(length float64) *Transfer {
+	if s.speedtest.QUICClient != nil {
+		return s.testQUIC("upload", s.speedtest.CliFlags.UploadSizes, length)
+	}
 	ci := make(chan int)
-	co := make(chan []int)
 	wg := new(sync.WaitGroup)
-	sizes := []int{32768, 65536, 131072, 262144, 524288, 1048576, 7340032}
-	start := time.Now()
+	sizes := s.speedtest.CliFlags.UploadSizes
+	s.initPool()
+	state := newTransferState(length, s.speedtest.CliFlags.Ramp, s.speedtest.Threads)
 
-	for i := 0; i < 8; i++ {
+	cpuStart, _ := processCPUTime()
+	_, txStart, ifOK := s.speedtest.interfaceSnapshot()
+
+	for i := 0; i < s.speedtest.Threads; i++ {
 		wg.Add(1)
-		go s.Uploader(ci, co, wg, start, length)
+		go s.Uploader(ci, wg, state, i)
 	}
 
+	stop := make(chan struct{})
+	samples := make(chan []float64)
+	s.speedtest.progress(ProgressEvent{Type: "start", Phase: "upload"})
+	go s.sampleRate("upload", state, time.Second, stop, samples)
+
 	var tmp int
 	for _, size := range sizes {
-		for i := 0; i < 4; i++ {
+		for i := 0; i < requestsPerSize; i++ {
 			tmp += size
 			ci <- size
 		}
@@ -568,22 +2657,37 @@ func (s *Server) TestUpload(length float64) (float64, time.Duration) {
 	close(ci)
 	wg.Wait()
 
-	total := time.Since(start)
+	total := state.window(time.Now())
+	close(stop)
 	s.speedtest.Printf("\n")
 
-	var totalSize int
-	for i := 0; i < 8; i++ {
-		chunks := <-co
-		for _, chunk := range chunks {
-			totalSize += chunk
-		}
+	transfer := &Transfer{
+		Bytes:    state.transferred(),
+		Duration: total,
+		Samples:  <-samples,
+		CPUUsage: cpuUsage(cpuStart, state.start),
 	}
-
-	return float64(totalSize) * 8, total
+	transfer.Connections = state.connections(total)
+	if _, txEnd, ok := s.speedtest.interfaceSnapshot(); ok && ifOK {
+		transfer.InterfaceBytes = txEnd - txStart
+	}
+	s.speedtest.progressEnd("upload", state, transfer)
+	return transfer
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, `usage: %s [options]
+	fmt.Fprintf(os.Stderr, `usage: %[1]s [run] [options]
+       %[1]s list [options]
+       %[1]s history [options] FILE
+       %[1]s export [options] FILE
+       %[1]s verify [options] FILE
+       %[1]s usage [options]
+       %[1]s check --server ID | --host HOST:PORT [options]
+       %[1]s serve [options] [-- test options]
+       %[1]s collector [options] [-- test options]
+       %[1]s agent [options] [-- test options]
+       %[1]s service install|start|stop|uninstall
+       %[1]s completion bash|zsh|fish|powershell
 
 Command line interface for testing internet bandwidth using speedtest.net.
 --------------------------------------------------------------------------
@@ -595,33 +2699,558 @@ options:
 	os.Exit(2)
 }
 
-func printVersion() {
-	fmt.Println(version)
-	os.Exit(0)
+// Whether a flag was explicitly provided on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
-func main() {
-	speedtest := NewSpeedtest()
-
-	flag.Usage = usage
-	flag.BoolVar(&speedtest.CliFlags.Json, "json", false, "Suppress verbose output, only show basic information in JSON format")
-	flag.BoolVar(&speedtest.CliFlags.Xml, "xml", false, "Suppress verbose output, only show basic information in XML format")
-	flag.BoolVar(&speedtest.CliFlags.Csv, "csv", false, "Suppress verbose output, only show basic information in CSV format")
-	flag.BoolVar(&speedtest.CliFlags.Simple, "simple", false, "Suppress verbose output, only show basic information")
-	flag.BoolVar(&speedtest.CliFlags.List, "list", false, "Display a list of speedtest.net servers sorted by distance")
-	flag.BoolVar(&speedtest.CliFlags.Share, "share", false, "Generate and provide a URL to the speedtest.net share results image")
-	flag.BoolVar(&speedtest.CliFlags.Version, "version", false, "Show the version number and exit")
-	flag.IntVar(&speedtest.CliFlags.Server, "server", 0, "Specify a server ID to test against")
-	flag.StringVar(&speedtest.CliFlags.Source, "source", "", "Source IP address to bind to")
-	flag.Int64Var(&speedtest.CliFlags.Timeout, "timeout", 10, "Timeout in seconds")
-	flag.Parse()
-
-	if speedtest.CliFlags.Version {
-		printVersion()
+// Shortens the test for --quick, leaving explicitly provided settings alone
+func (c *CliFlags) ApplyQuick() {
+	if c.Threads == 0 {
+		c.Threads = quickThreads
+	}
+	if c.DownloadTime == 0 {
+		c.DownloadTime = quickLength
+	}
+	if c.UploadTime == 0 {
+		c.UploadTime = quickLength
+	}
+	if !isFlagSet("download-sizes") {
+		c.DownloadSizes = append(Sizes{}, quickDownloadSizes...)
+	}
+	if !isFlagSet("upload-sizes") {
+		c.UploadSizes = append(Sizes{}, quickUploadSizes...)
+	}
+}
+
+// Tunes the test for a class of link, leaving explicitly provided settings
+// alone
+func (c *CliFlags) ApplyProfile(profile string) error {
+	switch profile {
+	case "multi-gig", "lan":
+		// The default 8 connections, socket buffers and requests cannot keep
+		// enough data in flight to saturate 2.5, 5 or 10 Gbit/s links
+		if !isFlagSet("threads") {
+			c.Threads = multiGigThreads
+		}
+		if !isFlagSet("send-buffer") {
+			c.SendBuffer = multiGigSocketBuffer
+		}
+		if !isFlagSet("recv-buffer") {
+			c.RecvBuffer = multiGigSocketBuffer
+		}
+		if !isFlagSet("read-buffer") {
+			c.ReadBuffer = multiGigReadBuffer
+		}
+		if !isFlagSet("download-chunk") {
+			c.DownloadChunk = 10 * downloadChunkSize
+		}
+		if !isFlagSet("upload-chunk") {
+			c.UploadChunk = maxUploadChunkSize
+		}
+		if !isFlagSet("ramp") {
+			c.Ramp = multiGigRamp
+		}
+		if !isFlagSet("download-sizes") {
+			c.DownloadSizes = append(Sizes{}, multiGigDownloadSizes...)
+		}
+		if !isFlagSet("upload-sizes") {
+			c.UploadSizes = append(Sizes{}, multiGigUploadSizes...)
+		}
+		if profile == "multi-gig" {
+			return nil
+		}
+		// Local links reach full speed quickly, but the ramp and a long
+		// steady state keep slow starts, caches and power management from
+		// skewing what is measured
+		if !isFlagSet("ramp") {
+			c.Ramp = lanRamp
+		}
+		if !isFlagSet("download-time") {
+			c.DownloadTime = lanLength
+		}
+		if !isFlagSet("upload-time") {
+			c.UploadTime = lanLength
+		}
+		if !isFlagSet("ping-count") {
+			c.PingCount = lanPingCount
+		}
+		return nil
+	}
+	return fmt.Errorf("Invalid profile %s, must be multi-gig or lan", profile)
+}
+
+// Chooses thread count, request sizes and durations for the estimated link
+// speed, leaving explicitly provided settings alone
+func (s *Speedtest) ApplyAdaptive(estimate float64, config *Configuration) {
+	tier := adaptiveTiers[len(adaptiveTiers)-1]
+	for _, t := range adaptiveTiers {
+		if estimate < t.maxRate {
+			tier = t
+			break
+		}
+	}
+
+	if !isFlagSet("threads") {
+		s.Threads = tier.threads
+	}
+	if !isFlagSet("download-time") {
+		config.Download.Length = tier.length.Seconds()
+	}
+	if !isFlagSet("upload-time") {
+		config.Upload.Length = tier.length.Seconds()
+	}
+	if !isFlagSet("download-sizes") {
+		s.CliFlags.DownloadSizes = append(Sizes{}, tier.downloadSizes...)
+	}
+	if !isFlagSet("upload-sizes") {
+		s.CliFlags.UploadSizes = append(Sizes{}, tier.uploadSizes...)
+	}
+	s.Debugf("Adaptive settings: %d threads, %.0f/%.0f second tests, download sizes %s, upload sizes %s",
+		s.Threads, config.Download.Length, config.Upload.Length, &s.CliFlags.DownloadSizes, &s.CliFlags.UploadSizes)
+}
+
+// Flags results and warns when a test was likely limited by CPU
+func (s *Speedtest) checkCPU(phase string, transfer *Transfer) {
+	s.Debugf("CPU usage during %s test: %.0f%%", phase, transfer.CPUUsage*100)
+	if transfer.CPUSaturated() {
+		s.Results.CPUSaturated = true
+		s.Printf("Warning: CPU usage was %.0f%% during the %s test, the result may understate the link speed\n", transfer.CPUUsage*100, phase)
+	}
+}
+
+// Records the results of the download test
+func (s *Speedtest) recordDownload(download *Transfer) {
+	s.Results.Download = download.Rate()
+	s.Results.DownloadSamples = download.Samples
+	s.checkCPU("download", download)
+	s.Results.DownloadConns = download.Connections
+	s.checkBalance("download", download)
+	s.Results.DownloadTCP = download.TCPStats()
+	if s.Results.Interface != nil {
+		s.Results.Interface.DownloadBytes = download.InterfaceBytes
+		s.Results.Interface.DownloadMeasured = download.Bytes
+		s.Printf("Interface %s received %s, %s measured\n", s.Interface, formatBytes(int64(download.InterfaceBytes)), formatBytes(download.Bytes))
+	}
+	if p := s.Results.Precision; p != nil {
+		p.DownloadBytes, p.DownloadDuration = download.Bytes, download.Duration.Nanoseconds()
+		s.Printf("Download measured %d bytes in %s\n", download.Bytes, download.Duration)
+	}
+	s.Printf("Download: %s\n", s.Results.rateUnit.Format(s.Results.Download))
+}
+
+// Records the results of the upload test
+func (s *Speedtest) recordUpload(upload *Transfer) {
+	s.Results.Upload = upload.Rate()
+	s.Results.UploadSamples = upload.Samples
+	s.checkCPU("upload", upload)
+	s.Results.UploadConns = upload.Connections
+	s.checkBalance("upload", upload)
+	s.Results.UploadTCP = upload.TCPStats()
+	if s.Results.Interface != nil {
+		s.Results.Interface.UploadBytes = upload.InterfaceBytes
+		s.Results.Interface.UploadMeasured = upload.Bytes
+		s.Printf("Interface %s sent %s, %s measured\n", s.Interface, formatBytes(int64(upload.InterfaceBytes)), formatBytes(upload.Bytes))
+	}
+	if p := s.Results.Precision; p != nil {
+		p.UploadBytes, p.UploadDuration = upload.Bytes, upload.Duration.Nanoseconds()
+		s.Printf("Upload measured %d bytes in %s\n", upload.Bytes, upload.Duration)
+	}
+	s.Printf("Upload: %s\n", s.Results.rateUnit.Format(s.Results.Upload))
+}
+
+// Flags results and warns when throughput was imbalanced between connections
+func (s *Speedtest) checkBalance(phase string, transfer *Transfer) {
+	for i, c := range transfer.Connections {
+		s.Debugf("%s connection %d: %s, %0.2f Mbit/s", phase, i, formatBytes(c.Bytes), c.Rate/1000/1000)
+		if c.TCP != nil {
+			s.Debugf("%s connection %d: %d retransmits, RTT %0.2f ms, delivery rate %0.2f Mbit/s", phase, i, c.TCP.Retransmits, c.TCP.RTT, c.TCP.DeliveryRate/1000/1000)
+		}
+	}
+	if transfer.Imbalanced() {
+		s.Results.Imbalanced = true
+		s.Printf("Warning: throughput was imbalanced between %s connections, which may indicate per flow policing\n", phase)
+	}
+}
+
+// Whether name is a subcommand that runs as a daemon
+func isDaemonSubcommand(name string) bool {
+	return name == "serve" || name == "collector" || name == "agent"
+}
+
+// Runs the subcommand named by args[0], returning false when it is not a
+// subcommand
+func runSubcommand(args []string) bool {
+	switch args[0] {
+	case "serve":
+		serve(args[1:])
+	case "collector":
+		collector(args[1:])
+	case "agent":
+		agent(args[1:])
+	case "service":
+		service(args[1:])
+	case "history":
+		history(args[1:])
+	case "export":
+		export(args[1:])
+	case "verify":
+		verify(args[1:])
+	case "usage":
+		dataUsage(args[1:])
+	case "check":
+		check(args[1:])
+	default:
+		return false
+	}
+	return true
+}
+
+func serviceUsage() {
+	fmt.Fprintf(os.Stderr, `usage: %[1]s service install serve|collector|agent [options]
+       %[1]s service start|stop|uninstall
+
+Manage the Windows service running %[1]s serve, collector or agent.
+`, path.Base(os.Args[0]))
+	os.Exit(2)
+}
+
+func printVersion() {
+	fmt.Println(version)
+	os.Exit(0)
+}
+
+func main() {
+	if len(os.Args) > 1 && runSubcommand(os.Args[1:]) {
+		return
+	}
+
+	speedtest := NewSpeedtest()
+
+	flag.Usage = usage
+	flag.BoolVar(&speedtest.CliFlags.Json, "json", false, "Suppress verbose output, only show basic information in JSON format")
+	flag.BoolVar(&speedtest.CliFlags.Xml, "xml", false, "Suppress verbose output, only show basic information in XML format")
+	flag.BoolVar(&speedtest.CliFlags.Csv, "csv", false, "Suppress verbose output, only show basic information in CSV format")
+	flag.BoolVar(&speedtest.CliFlags.CsvExtended, "csv-extended", false, "Add data used, tags and plan percentage columns to CSV output")
+	flag.BoolVar(&speedtest.CliFlags.Simple, "simple", false, "Suppress verbose output, only show basic information")
+	flag.BoolVar(&speedtest.CliFlags.List, "list", false, "Display a list of speedtest.net servers sorted by distance, the same as the list subcommand")
+	flag.BoolVar(&speedtest.CliFlags.Share, "share", false, "Generate and provide a URL to the speedtest.net share results image")
+	flag.StringVar(&speedtest.CliFlags.ShareSave, "share-save", "", "Save the speedtest.net share results image to `FILE`, implies --share")
+	flag.StringVar(&speedtest.CliFlags.SubmitURL, "submit-url", "", "Also POST the signed result form to `URL`, such as a self-hosted collector")
+	flag.StringVar(&speedtest.CliFlags.SignKey, "sign-key", "", "Sign the results with an HMAC of their key fields using `KEY`, check signatures with the verify subcommand (default from $"+signKeyEnv+")")
+	flag.BoolVar(&speedtest.CliFlags.Anonymize, "anonymize", false, "Mask the client IP address and omit client coordinates in JSON, XML and CSV output")
+	flag.StringVar(&speedtest.CliFlags.PingURL, "ping-url", "", "Request `URL` when the test completes, or URL/fail when it fails, for dead man's switch services such as healthchecks.io")
+	flag.StringVar(&speedtest.CliFlags.LockFile, "lock-file", "", "Exit instead of running when another test holds a lock on `FILE`, so that tests do not overlap")
+	flag.BoolVar(&speedtest.CliFlags.JsonCompact, "json-compact", false, "Suppress verbose output, only show basic information in JSON format on a single line, the same as --format jsonl")
+	flag.StringVar(&speedtest.CliFlags.Progress, "progress", "", "Write progress events during the download and upload tests to stdout, json for a JSON object per line. The results are written as a final JSON line unless another format is selected")
+	flag.StringVar(&speedtest.CliFlags.Format, "format", "", "Comma separated output formats, json, jsonl for JSON on a single line, xml, csv, simple or influx for InfluxDB line protocol. Formats also given an --output file are only written to it, one other goes to stdout")
+	speedtest.CliFlags.Exclude = ServerIDs{}
+	flag.Var(speedtest.CliFlags.Exclude, "exclude", "Comma separated server IDs to never select (may be repeated)")
+	flag.Var(&speedtest.CliFlags.Pool, "pool", "Comma separated server IDs to select from, trying them in order and selecting the first that responds (may be repeated)")
+	flag.Var(&speedtest.CliFlags.Outputs, "output", "Also write the results to a file, as `[FORMAT:]PATH` with the format taken from the extension when not given (may be repeated)")
+	flag.StringVar(&speedtest.CliFlags.Schema, "schema", fmt.Sprintf("v%d", schemaVersion), "Version of the JSON and XML results schema to emit, for parsers written against an older version")
+	flag.BoolVar(&speedtest.CliFlags.SkipIPLookup, "skip-ip-lookup", false, "Do not look up the public IPv4 and IPv6 addresses with IP lookup services, relying on the speedtest.net configuration for the client IP")
+	flag.StringVar(&speedtest.CliFlags.ExpectISP, "expect-isp", "", "Flag the results as routed over a VPN when the ISP reported for the client does not contain `NAME`")
+	flag.IntVar(&speedtest.CliFlags.RouteHops, "route-hops", 0, "Trace and record the first `N` hops of the route to the server, requires privileges to open a raw ICMP socket")
+	flag.StringVar(&speedtest.CliFlags.GeoIPDB, "geoip-db", "", "Comma separated MaxMind City, ISP or ASN databases to look up the client location and ISP in locally, instead of relying on the configuration, and the client and server ASNs")
+	flag.Float64Var(&speedtest.CliFlags.Latitude, "lat", 0, "Latitude to measure server distances from, instead of the GeoIP location from the configuration, requires --lon")
+	flag.Float64Var(&speedtest.CliFlags.Longitude, "lon", 0, "Longitude to measure server distances from, instead of the GeoIP location from the configuration, requires --lat")
+	flag.StringVar(&speedtest.CliFlags.RateUnit, "units-speed", "auto", "Unit to display speeds in, auto, kbit, mbit or gbit, for the interactive and simple output")
+	flag.StringVar(&speedtest.CliFlags.DistanceUnit, "units-distance", "km", "Unit to display distances in, km or mi, for the server list, interactive output and CSV")
+	flag.StringVar(&speedtest.CliFlags.Compat, "compat", "", "Emit JSON results in the format of another client, python for sivel/speedtest-cli")
+	flag.StringVar(&speedtest.CliFlags.PreHook, "pre-hook", "", "Shell command to run before the test, the test is aborted if it fails")
+	flag.StringVar(&speedtest.CliFlags.PostHook, "post-hook", "", "Shell command to run after the test, with the results in SPEEDTEST_* environment variables such as SPEEDTEST_DOWNLOAD_BPS, and SPEEDTEST_STATUS set to success, invalid or failed")
+	flag.BoolVar(&speedtest.CliFlags.Otel, "otel", false, "Export traces of the test phases and metrics of the results over OTLP, configured with the OTEL_EXPORTER_OTLP_* environment variables (requires building with -tags otel)")
+	flag.BoolVar(&speedtest.CliFlags.Version, "version", false, "Show the version number and exit")
+	flag.IntVar(&speedtest.CliFlags.Server, "server", 0, "Specify a server ID to test against")
+	flag.StringVar(&speedtest.CliFlags.Source, "source", "", "Source IP address to bind to")
+	flag.BoolVar(&speedtest.CliFlags.Insecure, "insecure", false, "Skip TLS certificate verification")
+	flag.StringVar(&speedtest.CliFlags.Transport, "transport", "tcp", "Transport for the download and upload tests, tcp for the speedtest.net protocol, or experimental quic for HTTP/3 against --quic-url (requires building with -tags quic)")
+	flag.StringVar(&speedtest.CliFlags.QUICURL, "quic-url", defaultQUICURL, "Base `URL` of the HTTP/3 endpoint for --transport quic, serving __down?bytes=N and accepting uploads to __up")
+	flag.BoolVar(&speedtest.CliFlags.Secure, "secure", false, "Prefer TLS for test connections to servers that accept it, which also bypasses transparent proxies that skew plaintext results")
+	flag.StringVar(&speedtest.CliFlags.CACert, "cacert", "", "PEM encoded CA bundle used to verify TLS certificates")
+	flag.StringVar(&speedtest.CliFlags.Congestion, "congestion", "", "TCP congestion control algorithm to use for test connections, such as bbr or cubic (Linux only)")
+	flag.IntVar(&speedtest.CliFlags.DSCP, "dscp", 0, "DSCP value (0-63) to mark test connections with (Linux only)")
+	flag.IntVar(&speedtest.CliFlags.FwMark, "fwmark", 0, "Firewall mark (SO_MARK) to apply to test connections (Linux only)")
+	flag.IntVar(&speedtest.CliFlags.SendBuffer, "send-buffer", 0, "Socket send buffer size (SO_SNDBUF) in bytes for test connections")
+	flag.IntVar(&speedtest.CliFlags.RecvBuffer, "recv-buffer", 0, "Socket receive buffer size (SO_RCVBUF) in bytes for test connections")
+	flag.BoolVar(&speedtest.CliFlags.Nagle, "nagle", false, "Enable Nagle's algorithm (disable TCP_NODELAY) on test connections")
+	flag.DurationVar(&speedtest.CliFlags.KeepAlive, "keepalive", 0, "TCP keepalive interval for test connections, 0 uses the system default and a negative value disables keepalives")
+	flag.IntVar(&speedtest.CliFlags.Threads, "threads", 0, "Number of concurrent connections used for the download and upload tests (default from the speedtest.net configuration)")
+	flag.DurationVar(&speedtest.CliFlags.DownloadTime, "download-time", 0, "Duration of the download test (default from the speedtest.net configuration)")
+	flag.DurationVar(&speedtest.CliFlags.UploadTime, "upload-time", 0, "Duration of the upload test (default from the speedtest.net configuration)")
+	flag.Var(&speedtest.CliFlags.DownloadSizes, "download-sizes", "Comma separated list of request sizes in bytes for the download test")
+	flag.Var(&speedtest.CliFlags.UploadSizes, "upload-sizes", "Comma separated list of request sizes in bytes for the upload test")
+	flag.StringVar(&speedtest.CliFlags.Config, "config", "", "JSON configuration `FILE` with blacklist, plan and monthly_budget settings (default $"+configEnv+", or speedtest/config.json in the user configuration directory)")
+	flag.Var(&speedtest.CliFlags.MonthlyBudget, "monthly-budget", "Refuse to run once test runs have used this many `bytes` in the calendar month, such as 50GB, limiting tests to what remains, overriding the configuration file")
+	flag.Var(&speedtest.CliFlags.MaxBytes, "max-bytes", "Stop the download and upload tests once each has transferred this many `bytes`, such as 100MB")
+	flag.Var(&speedtest.CliFlags.ReadBuffer, "read-buffer", "Size in `bytes` of the buffer used to read from each test connection, such as 256KiB")
+	flag.Var(&speedtest.CliFlags.DownloadChunk, "download-chunk", "Largest single download request in `bytes` sent to the server, such as 10MB")
+	flag.Var(&speedtest.CliFlags.UploadChunk, "upload-chunk", "Largest single upload request in `bytes` sent to the server, such as 1MB, at most 1MB")
+	flag.DurationVar(&speedtest.CliFlags.Ramp, "ramp", 0, "Time after the first byte of the download and upload tests that is not measured, while connections ramp up, such as 2s")
+	flag.StringVar(&speedtest.CliFlags.Profile, "profile", "", "Tune the test for a class of link, multi-gig for 2.5 Gbit/s and faster, with more connections, larger buffers and requests, and a ramp, or lan for local servers, adding longer steady state windows, exact byte counts and durations in ns, and CPU pinning hints")
+	flag.BoolVar(&speedtest.CliFlags.EstimateOnly, "estimate-only", false, "Show the estimated maximum data usage of a test and exit")
+	flag.BoolVar(&speedtest.CliFlags.Quick, "quick", false, "Run a shorter, approximate test using fewer connections and smaller requests")
+	flag.Var(&speedtest.CliFlags.PlanDownload, "plan-download", "Advertised download `SPEED` of the internet plan, such as 500mbit, to report results as a percentage of, overriding the configuration file")
+	flag.Var(&speedtest.CliFlags.PlanUpload, "plan-upload", "Advertised upload `SPEED` of the internet plan, such as 50mbit, to report results as a percentage of, overriding the configuration file")
+	flag.Var(&speedtest.CliFlags.LimitRate, "limit-rate", "Cap the transfer rate of the test in each direction at this `SPEED`, such as 200mbit, to take regular samples without saturating the link")
+	flag.BoolVar(&speedtest.CliFlags.Duplex, "duplex", false, "Run the download and upload tests at the same time, also measuring latency while they run")
+	flag.BoolVar(&speedtest.CliFlags.NoDownload, "no-download", false, "Do not perform the download test")
+	flag.BoolVar(&speedtest.CliFlags.NoUpload, "no-upload", false, "Do not perform the upload test")
+	flag.BoolVar(&speedtest.CliFlags.Adaptive, "adaptive", false, "Estimate the link speed with a short probe and size the test accordingly")
+	flag.BoolVar(&speedtest.CliFlags.PathMTU, "mtu", false, "Probe the path MTU to the selected server and warn when it is reduced (Linux only)")
+	flag.BoolVar(&speedtest.CliFlags.IfCounters, "interface-counters", false, "Report the bytes observed by the OS on the test interface alongside the measured bytes (Linux only)")
+	flag.IntVar(&speedtest.CliFlags.PingCount, "ping-count", 3, "Number of latency samples to take from each server")
+	flag.IntVar(&speedtest.CliFlags.Candidates, "candidates", 5, "Number of closest servers to test latency against when selecting a server")
+	flag.StringVar(&speedtest.CliFlags.Select, "select", "latency", "Server selection strategy, one of latency, distance or hybrid")
+	flag.StringVar(&speedtest.CliFlags.Netns, "netns", "", "Run inside the named network namespace (Linux only)")
+	flag.StringVar(&speedtest.CliFlags.VRF, "vrf", "", "Bind all connections to the named VRF device (Linux only)")
+	flag.BoolVar(&speedtest.CliFlags.Debug, "debug", false, "Show debug output on stderr")
+	flag.Var(speedtest.CliFlags.Tags, "tag", "Attach a custom label to the results, in the form `KEY=VALUE` (may be repeated)")
+	flag.Var(speedtest.CliFlags.Resolve, "resolve", "Use ADDRESS for HOST:PORT instead of DNS, in the form `HOST:PORT:ADDRESS` (may be repeated)")
+	flag.Int64Var(&speedtest.CliFlags.Timeout, "timeout", 10, "Timeout in seconds")
+	flag.DurationVar(&speedtest.CliFlags.ConnectTimeout, "connect-timeout", 0, "Timeout for establishing connections, such as 5s (default --timeout)")
+	flag.DurationVar(&speedtest.CliFlags.IOTimeout, "io-timeout", 0, "Longest a single read or write on a test connection may block before the connection is aborted, such as 5s (default --timeout)")
+	// No subcommand runs a test, as before subcommands were added
+	args := os.Args[1:]
+	list := false
+	if len(args) > 0 {
+		switch args[0] {
+		case "completion":
+			completion(args[1:])
+			return
+		case "run":
+			args = args[1:]
+		case "list":
+			args = args[1:]
+			list = true
+		}
+	}
+
+	flag.CommandLine.Parse(args)
+	if list {
+		speedtest.CliFlags.List = true
+	}
+
+	if speedtest.CliFlags.Version {
+		printVersion()
+	}
+
+	if speedtest.CliFlags.Netns != "" {
+		if err := enterNetns(speedtest.CliFlags.Netns); err != nil {
+			errorf(err.Error())
+		}
+	}
+
+	speedtest.Timeout = time.Duration(speedtest.CliFlags.Timeout) * time.Second
+	if speedtest.CliFlags.ConnectTimeout < 0 {
+		errorf("Invalid connect timeout %s", speedtest.CliFlags.ConnectTimeout)
+	}
+	speedtest.ConnectTimeout = speedtest.CliFlags.ConnectTimeout
+	if speedtest.ConnectTimeout == 0 {
+		speedtest.ConnectTimeout = speedtest.Timeout
+	}
+	if speedtest.CliFlags.IOTimeout < 0 {
+		errorf("Invalid I/O timeout %s", speedtest.CliFlags.IOTimeout)
+	}
+	speedtest.IOTimeout = speedtest.CliFlags.IOTimeout
+	if speedtest.IOTimeout == 0 {
+		speedtest.IOTimeout = speedtest.Timeout
+	}
+
+	if speedtest.CliFlags.PingURL != "" {
+		errorHooks = append(errorHooks, func() {
+			if err := speedtest.PingHealthcheck("/fail"); err != nil {
+				speedtest.Debugf("Could not ping %s/fail: %s", speedtest.CliFlags.PingURL, err)
+			}
+		})
+	}
+
+	if speedtest.CliFlags.Profile != "" {
+		if speedtest.CliFlags.Quick || speedtest.CliFlags.Adaptive {
+			errorf("--profile cannot be combined with --quick or --adaptive")
+		}
+		if err := speedtest.CliFlags.ApplyProfile(speedtest.CliFlags.Profile); err != nil {
+			errorf(err.Error())
+		}
+	}
+
+	if speedtest.CliFlags.Quick {
+		speedtest.CliFlags.ApplyQuick()
+		speedtest.Results.Approximate = true
+	}
+
+	if speedtest.CliFlags.PingCount < 1 {
+		errorf("Invalid ping count %d, must be at least 1", speedtest.CliFlags.PingCount)
+	}
+
+	schema, err := parseSchemaVersion(speedtest.CliFlags.Schema)
+	if err != nil {
+		errorf(err.Error())
+	}
+	speedtest.Results.SchemaVersion = schema
+
+	if err := validateCompat(speedtest.CliFlags.Compat); err != nil {
+		errorf(err.Error())
+	}
+	speedtest.Results.compat = speedtest.CliFlags.Compat
+	speedtest.Results.csvExtended = speedtest.CliFlags.CsvExtended
+
+	distanceUnit, err := parseDistanceUnit(speedtest.CliFlags.DistanceUnit)
+	if err != nil {
+		errorf(err.Error())
+	}
+	speedtest.Results.distanceUnit = distanceUnit
+
+	rateUnit, err := parseRateUnit(speedtest.CliFlags.RateUnit)
+	if err != nil {
+		errorf(err.Error())
+	}
+	speedtest.Results.rateUnit = rateUnit
+
+	locationSet := isFlagSet("lat") || isFlagSet("lon")
+	if locationSet {
+		if !isFlagSet("lat") || !isFlagSet("lon") {
+			errorf("--lat and --lon must be used together")
+		}
+		if math.Abs(speedtest.CliFlags.Latitude) > 90 || math.Abs(speedtest.CliFlags.Longitude) > 180 {
+			errorf("Invalid location %f,%f", speedtest.CliFlags.Latitude, speedtest.CliFlags.Longitude)
+		}
+	}
+
+	if speedtest.CliFlags.Candidates < 1 {
+		errorf("Invalid candidate count %d, must be at least 1", speedtest.CliFlags.Candidates)
+	}
+
+	selector, ok := serverSelectors[speedtest.CliFlags.Select]
+	if !ok {
+		errorf("Invalid server selection strategy %s, must be one of latency, distance or hybrid", speedtest.CliFlags.Select)
+	}
+
+	formats, err := speedtest.CliFlags.OutputFormats()
+	if err != nil {
+		errorf(err.Error())
+	}
+
+	switch speedtest.CliFlags.Progress {
+	case "":
+	case "json":
+		speedtest.Progress = writeProgressJSON
+		if len(formats) == 0 {
+			formats = []string{"jsonl"}
+		}
+	default:
+		errorf("Invalid progress format %s, must be json", speedtest.CliFlags.Progress)
+	}
+	// serve mode reads progress from stderr, keeping stdout for the results
+	if os.Getenv(progressEnv) != "" {
+		speedtest.Progress = writeProgress
+	}
+	if speedtest.CliFlags.Compat != "" {
+		for _, format := range formats {
+			if format == "xml" {
+				errorf("--compat is only supported with JSON output")
+			}
+		}
+		for _, f := range speedtest.CliFlags.Outputs {
+			if f.format == "xml" {
+				errorf("--compat is only supported with JSON output")
+			}
+		}
+	}
+
+	if speedtest.CliFlags.ReadBuffer < 1 {
+		errorf("Invalid read buffer size %d", speedtest.CliFlags.ReadBuffer)
+	}
+
+	if speedtest.CliFlags.DownloadChunk < 1 {
+		errorf("Invalid download chunk size %d", speedtest.CliFlags.DownloadChunk)
+	}
+
+	// Upload requests must hold their own header and fit in the payload
+	if speedtest.CliFlags.UploadChunk < 32 || speedtest.CliFlags.UploadChunk > maxUploadChunkSize {
+		errorf("Invalid upload chunk size %d, must be between 32 and %d", speedtest.CliFlags.UploadChunk, maxUploadChunkSize)
+	}
+
+	if speedtest.CliFlags.Ramp < 0 {
+		errorf("Invalid ramp %s", speedtest.CliFlags.Ramp)
+	}
+
+	if speedtest.CliFlags.Threads < 0 {
+		errorf("Invalid thread count %d", speedtest.CliFlags.Threads)
+	}
+
+	var runConfig *Config
+	if speedtest.CliFlags.Config != "" {
+		runConfig, err = LoadConfig(speedtest.CliFlags.Config)
+	} else {
+		runConfig, err = LoadDefaultConfig()
+	}
+	if err != nil {
+		errorf("Could not read configuration: %s", err)
+	}
+	if !isFlagSet("plan-download") {
+		speedtest.CliFlags.PlanDownload = runConfig.Plan.Download
+	}
+	if !isFlagSet("plan-upload") {
+		speedtest.CliFlags.PlanUpload = runConfig.Plan.Upload
+	}
+	if !isFlagSet("monthly-budget") {
+		speedtest.CliFlags.MonthlyBudget = runConfig.MonthlyBudget
+	}
+	for _, id := range runConfig.Blacklist {
+		speedtest.CliFlags.Exclude[id] = true
+	}
+
+	if speedtest.CliFlags.Duplex && (speedtest.CliFlags.NoDownload || speedtest.CliFlags.NoUpload) {
+		errorf("--duplex cannot be combined with --no-download or --no-upload")
+	}
+
+	speedtest.sendLimit = newRateLimiter(float64(speedtest.CliFlags.LimitRate))
+	speedtest.receiveLimit = newRateLimiter(float64(speedtest.CliFlags.LimitRate))
+
+	if speedtest.CliFlags.DSCP < 0 || speedtest.CliFlags.DSCP > 63 {
+		errorf("Invalid DSCP value %d, must be between 0 and 63", speedtest.CliFlags.DSCP)
+	}
+
+	if err := speedtest.ConfigureTLS(); err != nil {
+		errorf(err.Error())
+	}
+
+	switch speedtest.CliFlags.Transport {
+	case "tcp":
+	case "quic":
+		// HTTP/3 dials its own UDP sockets, which the options applied to
+		// test connections do not reach
+		if speedtest.CliFlags.Source != "" || len(speedtest.CliFlags.Resolve) > 0 || speedtest.CliFlags.VRF != "" || speedtest.CliFlags.DSCP != 0 || speedtest.CliFlags.FwMark != 0 {
+			errorf("--transport quic cannot be combined with --source, --resolve, --vrf, --dscp or --fwmark")
+		}
+		transport, err := speedtest.http3Transport()
+		if err != nil {
+			errorf(err.Error())
+		}
+		speedtest.QUICClient = &http.Client{Transport: transport}
+	default:
+		errorf("Invalid transport %s, must be tcp or quic", speedtest.CliFlags.Transport)
+	}
+
+	if speedtest.CliFlags.Otel {
+		shutdown, err := setupTelemetry(speedtest)
+		if err != nil {
+			errorf("Could not set up OpenTelemetry: %s", err)
+		}
+		errorHooks = append(errorHooks, func() {
+			shutdown(true)
+		})
+		defer shutdown(false)
 	}
 
-	speedtest.Timeout = time.Duration(speedtest.CliFlags.Timeout) * time.Second
-
 	if speedtest.CliFlags.Source != "" {
 		source, err := net.ResolveTCPAddr("tcp", speedtest.CliFlags.Source+":0")
 		if err != nil {
@@ -633,69 +3262,462 @@ func main() {
 		speedtest.Source = nil
 	}
 
-	if speedtest.CliFlags.Json || speedtest.CliFlags.Xml || speedtest.CliFlags.Csv || speedtest.CliFlags.Simple {
+	if len(formats) > 0 {
 		speedtest.CliFlags.Interactive = false
 	}
 
+	if speedtest.CliFlags.EstimateOnly {
+		download, upload := speedtest.EstimateUsage()
+		fmt.Printf("Download: up to %s\n", formatBytes(download))
+		fmt.Printf("Upload: up to %s\n", formatBytes(upload))
+		fmt.Printf("Total: up to %s, plus configuration and server list retrieval\n", formatBytes(download+upload))
+		os.Exit(0)
+	}
+
+	if speedtest.CliFlags.LockFile != "" {
+		lock, err := acquireLock(speedtest.CliFlags.LockFile)
+		if err == errRunning {
+			errorf("Another test is already running, %s is locked", speedtest.CliFlags.LockFile)
+		} else if err != nil {
+			errorf("Could not lock %s: %s", speedtest.CliFlags.LockFile, err)
+		}
+		defer lock.Close()
+	}
+
+	// Metered connections, tests are limited to what remains of the budget
+	if budget := int64(speedtest.CliFlags.MonthlyBudget); budget > 0 && !speedtest.CliFlags.List {
+		usage, err := LoadUsage()
+		if err != nil {
+			errorf("Could not read data usage: %s", err)
+		}
+		used := usage.Month(time.Now()).Total()
+		if used >= budget {
+			errorf("Monthly data budget of %s is used up, %s used this month", formatBytes(budget), formatBytes(used))
+		}
+		tests := int64(2)
+		if speedtest.CliFlags.NoDownload || speedtest.CliFlags.NoUpload {
+			tests = 1
+		}
+		remaining := ByteSize((budget - used) / tests)
+		if speedtest.CliFlags.MaxBytes == 0 || speedtest.CliFlags.MaxBytes > remaining {
+			speedtest.Debugf("Limiting each test to %s of the remaining monthly budget", formatBytes(int64(remaining)))
+			speedtest.CliFlags.MaxBytes = remaining
+		}
+	}
+
+	// Data used by failed runs counts toward the month as well
+	usageRecorded := false
+	recordUsage := func() {
+		if usageRecorded {
+			return
+		}
+		usageRecorded = true
+		if err := RecordUsage(time.Now(), atomic.LoadInt64(&speedtest.bytesSent), atomic.LoadInt64(&speedtest.bytesReceived)); err != nil {
+			speedtest.Debugf("Could not record data usage: %s", err)
+		}
+	}
+	errorHooks = append(errorHooks, recordUsage)
+
+	if speedtest.CliFlags.PreHook != "" {
+		if err := runHook(speedtest.CliFlags.PreHook, []string{"SPEEDTEST_ID=" + speedtest.Results.ID}); err != nil {
+			errorf("Pre-hook %q failed: %s", speedtest.CliFlags.PreHook, err)
+		}
+	}
+
+	postHookRan := false
+	if speedtest.CliFlags.PostHook != "" {
+		errorHooks = append(errorHooks, func() {
+			if postHookRan {
+				return
+			}
+			env := append(speedtest.Results.Environ(), "SPEEDTEST_STATUS=failed")
+			if err := runHook(speedtest.CliFlags.PostHook, env); err != nil {
+				speedtest.Debugf("Post-hook %q failed: %s", speedtest.CliFlags.PostHook, err)
+			}
+		})
+	}
+
 	// ALL THE CPUS!
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	// Looked up while the configuration is retrieved, as it does not depend
+	// on it
+	lookupIPs := !speedtest.CliFlags.SkipIPLookup && !speedtest.CliFlags.List
+	publicIPs := make(chan [2]string, 1)
+	if lookupIPs {
+		go func() {
+			ipv4, ipv6 := speedtest.PublicIPs()
+			publicIPs <- [2]string{ipv4, ipv6}
+		}()
+	}
+
 	speedtest.Printf("Retrieving speedtest.net configuration...\n")
+	endPhase := speedtest.Phase("config")
 	config, err := speedtest.GetConfiguration()
 	if err != nil {
-		errorf(err.Error())
+		speedtest.Printf("%s, continuing without it\n", err)
+		speedtest.Debugf("Could not retrieve configuration: %s", err)
+	}
+	endPhase()
+	config.ApplyDefaults()
+
+	if lookupIPs {
+		ips := <-publicIPs
+		speedtest.Results.PublicIPv4, speedtest.Results.PublicIPv6 = ips[0], ips[1]
+		if config.Client.IP == "" {
+			config.Client.IP = speedtest.Results.PublicIPv4
+			if config.Client.IP == "" {
+				config.Client.IP = speedtest.Results.PublicIPv6
+			}
+		}
 	}
 
-	speedtest.Printf("Testing from %s (%s)...\n", config.Client.ISP, config.Client.IP)
+	if speedtest.CliFlags.GeoIPDB != "" && config.Client.IP != "" {
+		if err := config.Client.LookupGeoIP(strings.Split(speedtest.CliFlags.GeoIPDB, ",")); err != nil {
+			errorf("Could not look up client in GeoIP database: %s", err)
+		}
+	}
+
+	if config.Client.IP != "" {
+		speedtest.Printf("Testing from %s (%s)...\n", config.Client.ISP, config.Client.IP)
+	}
+	if locationSet {
+		speedtest.Debugf("Overriding GeoIP location %f,%f with %f,%f", config.Client.Latitude, config.Client.Longitude, speedtest.CliFlags.Latitude, speedtest.CliFlags.Longitude)
+		config.Client.Latitude = speedtest.CliFlags.Latitude
+		config.Client.Longitude = speedtest.CliFlags.Longitude
+	}
+	speedtest.Results.Client = &config.Client
+	speedtest.Results.Tags = speedtest.CliFlags.Tags
+
+	speedtest.Threads = speedtest.CliFlags.Threads
+	if speedtest.Threads == 0 {
+		speedtest.Threads = config.ServerConfig.Threads()
+	}
+	speedtest.Debugf("Using %d threads", speedtest.Threads)
+
+	if speedtest.CliFlags.DownloadTime > 0 {
+		config.Download.Length = speedtest.CliFlags.DownloadTime.Seconds()
+	}
+	if speedtest.CliFlags.UploadTime > 0 {
+		config.Upload.Length = speedtest.CliFlags.UploadTime.Seconds()
+	}
 
 	speedtest.Printf("Retrieving speedtest.net server list...\n")
+	endPhase = speedtest.Phase("servers")
 	servers, err := speedtest.GetServers(speedtest.CliFlags.Server)
+	endPhase()
 	if err != nil {
 		errorf(err.Error())
-	} else if len(servers.Servers) == 0 {
-		errorf("Failed to retrieve servers or invalid server ID specified")
+	}
+	servers.Exclude(speedtest.CliFlags.Exclude)
+	if len(servers.Servers) == 0 {
+		errorf("Failed to retrieve servers, invalid server ID specified or all servers excluded")
 	}
 
-	servers.SetDistances(config.Client.Latitude, config.Client.Longitude)
+	candidates := speedtest.CliFlags.Candidates
+	if config.Client.Latitude != 0 || config.Client.Longitude != 0 {
+		servers.SetDistances(config.Client.Latitude, config.Client.Longitude)
+	} else {
+		// Without a location only latency is meaningful, the server list is
+		// already ordered by proximity to the requesting address
+		speedtest.Printf("Client location is unknown, selecting server by latency only\n")
+		speedtest.CliFlags.Select = "latency"
+		selector = LatencySelector{}
+		if candidates < latencyOnlyCandidates {
+			candidates = latencyOnlyCandidates
+		}
+	}
 
 	if speedtest.CliFlags.List {
 		servers.SortServersByDistance()
 		for _, server := range servers.Servers {
-			speedtest.Printf("%5d) %s (%s, %s) [%0.2f km]\n", server.ID, server.Sponsor, server.Name, server.Country, server.Distance)
+			speedtest.Printf("%5d) %s (%s, %s) [%s]\n", server.ID, server.Sponsor, server.Name, server.Country, distanceUnit.Format(server.Distance))
 		}
 		os.Exit(0)
 	}
 
-	speedtest.Printf("Selecting best server based on latency...\n")
-	speedtest.Results.Server = servers.TestLatency()
+	endPhase = speedtest.Phase("selection")
+	if len(speedtest.CliFlags.Pool) > 0 {
+		speedtest.Printf("Selecting first responding server from pool %s...\n", &speedtest.CliFlags.Pool)
+		speedtest.Results.Server = servers.SelectPool(speedtest.CliFlags.Pool)
+		if speedtest.Results.Server == nil {
+			errorf("None of the servers in pool %s responded", &speedtest.CliFlags.Pool)
+		}
+	} else {
+		speedtest.Printf("Selecting best server based on %s...\n", speedtest.CliFlags.Select)
+		speedtest.Results.Server = selector.Select(servers, candidates)
+	}
+	endPhase()
 	speedtest.Results.Latency = float64(speedtest.Results.Server.Latency.Nanoseconds()) / 1000000.0
+	speedtest.Results.LatencyMin, speedtest.Results.LatencyMax, speedtest.Results.LatencyStdDev = speedtest.Results.Server.LatencyStats()
+	speedtest.Results.LatencyMethod = speedtest.Results.Server.latencyMethod
 	if speedtest.Results.Server.Latency == 0 {
 		errorf("Unable to test server latency, this may be caused by a connection failure")
 	}
 
-	speedtest.Printf("Hosted by %s (%s) [%0.2f km]: %0.2f ms\n", speedtest.Results.Server.Sponsor, speedtest.Results.Server.Name, speedtest.Results.Server.Distance, float64(speedtest.Results.Server.Latency.Nanoseconds())/1000000.0)
+	serverHost, _, _ := net.SplitHostPort(speedtest.Results.Server.Host)
+	speedtest.Results.DNS = speedtest.DNSTimings("www.speedtest.net", serverHost)
 
-	speedtest.Printf("Testing Download Speed")
-	downBits, downDuration := speedtest.Results.Server.TestDownload(config.Download.Length)
-	speedtest.Results.Download = downBits / downDuration.Seconds()
-	speedtest.Printf("Download: %0.2f Mbit/s\n", speedtest.Results.Download/1000/1000)
+	speedtest.Results.AddressFamily = "ipv4"
+	if speedtest.Results.Server.tcpAddr.IP.To4() == nil {
+		speedtest.Results.AddressFamily = "ipv6"
+	}
+	speedtest.Debugf("Connected to %s over %s", speedtest.Results.Server.tcpAddr, speedtest.Results.AddressFamily)
 
-	speedtest.Printf("Testing Upload Speed")
-	upBits, upDuration := speedtest.Results.Server.TestUpload(config.Upload.Length)
-	speedtest.Results.Upload = upBits / upDuration.Seconds()
-	speedtest.Printf("Upload: %0.2f Mbit/s\n", speedtest.Results.Upload/1000/1000)
+	speedtest.Results.Secure = speedtest.Results.Server.secure
+	speedtest.Results.Transport = speedtest.CliFlags.Transport
+	if speedtest.QUICClient != nil {
+		speedtest.Results.Endpoint = speedtest.CliFlags.QUICURL
+		speedtest.Printf("Testing throughput over HTTP/3 against %s\n", speedtest.CliFlags.QUICURL)
+	}
+	if rate := float64(speedtest.CliFlags.LimitRate); rate > 0 {
+		speedtest.Results.RateLimit = rate
+		speedtest.Printf("Limiting transfers to %s\n", speedtest.Results.rateUnit.Format(rate))
+	}
+	if speedtest.CliFlags.Secure && !speedtest.Results.Secure {
+		speedtest.Printf("Server does not accept TLS, testing over plaintext\n")
+	}
 
-	if speedtest.CliFlags.Share {
-		speedtest.Results.ToPng()
+	if iface, err := speedtest.FindInterface(speedtest.Results.Server.tcpAddr); err != nil {
+		speedtest.Debugf("Could not determine the test interface: %s", err)
+	} else {
+		speedtest.Results.InterfaceName = iface
 	}
 
-	if speedtest.CliFlags.Json {
-		speedtest.Results.ToJson()
-	} else if speedtest.CliFlags.Xml {
-		speedtest.Results.ToXml()
-	} else if speedtest.CliFlags.Csv {
-		speedtest.Results.ToCsv()
-	} else if speedtest.CliFlags.Simple {
-		speedtest.Results.ToSimple()
+	if speedtest.CliFlags.Profile == "lan" {
+		speedtest.Results.Precision = &Precision{}
+		speedtest.Results.Precision.setLatency(speedtest.Results.Server.latencySamples)
+		speedtest.cpuHints(speedtest.Results.InterfaceName)
+	}
+
+	// Gateway and first hops, to tell which LAN and uplink the test ran over
+	route := &Route{}
+	if route.Gateway, err = defaultGateway(speedtest.Results.InterfaceName, speedtest.Results.AddressFamily == "ipv6"); err != nil {
+		speedtest.Debugf("Could not determine the default gateway: %s", err)
+	}
+	if speedtest.CliFlags.RouteHops > 0 {
+		if route.Hops, err = speedtest.TraceRoute(speedtest.Results.Server.tcpAddr.IP, speedtest.CliFlags.RouteHops); err != nil {
+			speedtest.Printf("Could not trace the route to the server: %s\n", err)
+		}
+	}
+	if route.Gateway != "" || len(route.Hops) > 0 {
+		speedtest.Results.Route = route
+		if route.Gateway != "" {
+			speedtest.Debugf("Default gateway %s", route.Gateway)
+		}
+		for _, hop := range route.Hops {
+			if hop.Address == "" {
+				speedtest.Printf("Hop %d: *\n", hop.TTL)
+			} else {
+				speedtest.Printf("Hop %d: %s %0.2f ms\n", hop.TTL, hop.Address, hop.RTT)
+			}
+		}
+	}
+
+	// Autonomous systems at both ends, for analysis of results by peering
+	if speedtest.CliFlags.GeoIPDB != "" {
+		paths := strings.Split(speedtest.CliFlags.GeoIPDB, ",")
+		if ip := net.ParseIP(speedtest.Results.Client.IP); ip != nil {
+			if speedtest.Results.ClientASN, err = lookupASN(paths, ip); err != nil {
+				speedtest.Debugf("Could not look up the client ASN: %s", err)
+			}
+		}
+		if speedtest.Results.ServerASN, err = lookupASN(paths, speedtest.Results.Server.tcpAddr.IP); err != nil {
+			speedtest.Debugf("Could not look up the server ASN: %s", err)
+		}
+		if speedtest.Results.ClientASN != nil && speedtest.Results.ServerASN != nil {
+			speedtest.Printf("Testing from %s to %s\n", speedtest.Results.ClientASN, speedtest.Results.ServerASN)
+		}
+	}
+
+	// Accidental VPN routing commonly explains unexpectedly slow results
+	speedtest.Results.VPNReasons = tunnelReasons(speedtest.Results.InterfaceName, speedtest.Results.Client, speedtest.CliFlags.ExpectISP)
+	if len(speedtest.Results.VPNReasons) > 0 {
+		speedtest.Results.VPN = true
+		speedtest.Printf("Warning: traffic appears to be routed over a VPN or tunnel, %s\n", strings.Join(speedtest.Results.VPNReasons, ", "))
+	}
+
+	speedtest.Printf("Hosted by %s (%s) [%s]: %0.2f ms\n", speedtest.Results.Server.Sponsor, speedtest.Results.Server.Name, distanceUnit.Format(speedtest.Results.Server.Distance), float64(speedtest.Results.Server.Latency.Nanoseconds())/1000000.0)
+	speedtest.Printf("Latency min/max/stddev: %0.2f/%0.2f/%0.2f ms\n", speedtest.Results.LatencyMin, speedtest.Results.LatencyMax, speedtest.Results.LatencyStdDev)
+	if speedtest.Results.LatencyMethod != "tcp" {
+		speedtest.Printf("Latency was measured with %s, the server's test port may be unreachable\n", strings.ToUpper(speedtest.Results.LatencyMethod))
+	}
+
+	if speedtest.CliFlags.IfCounters {
+		iface, err := speedtest.FindInterface(speedtest.Results.Server.tcpAddr)
+		if err != nil {
+			speedtest.Printf("Could not determine the test interface: %s\n", err)
+		} else if _, _, err := interfaceCounters(iface); err != nil {
+			speedtest.Printf("Could not read counters for interface %s: %s\n", iface, err)
+		} else {
+			speedtest.Interface = iface
+			speedtest.Results.Interface = &InterfaceCounters{Name: iface}
+		}
+	}
+
+	if speedtest.CliFlags.PathMTU {
+		pmtu, err := speedtest.Results.Server.ProbePathMTU()
+		if err != nil {
+			speedtest.Printf("Could not determine the path MTU: %s\n", err)
+		} else {
+			speedtest.Results.PathMTU = pmtu
+			speedtest.Printf("Path MTU: %d (MSS %d)\n", pmtu.MTU, pmtu.MSS)
+			if pmtu.Reduced {
+				speedtest.Printf("Warning: path MTU is reduced, which is common with PPPoE or VPN links and can reduce throughput\n")
+			}
+		}
+	}
+
+	if speedtest.CliFlags.Adaptive {
+		speedtest.Printf("Estimating link speed")
+		probe := speedtest.Results.Server.TestDownload(probeLength.Seconds())
+		speedtest.Printf("Estimate: %s\n", rateUnit.Format(probe.Rate()))
+		speedtest.ApplyAdaptive(probe.Rate(), config)
+	}
+
+	if speedtest.CliFlags.Duplex {
+		speedtest.Printf("Testing Download and Upload Speed")
+		endPhase = speedtest.Phase("duplex")
+		download, upload, loaded := speedtest.Results.Server.TestDuplex(config.Download.Length, config.Upload.Length)
+		endPhase()
+		speedtest.recordDownload(download)
+		speedtest.recordUpload(upload)
+		speedtest.Results.Duplex = true
+		if len(loaded) > 0 {
+			var sum time.Duration
+			for _, sample := range loaded {
+				sum += sample
+			}
+			speedtest.Results.LoadedLatency = float64(sum/time.Duration(len(loaded))) / float64(time.Millisecond)
+			speedtest.Printf("Loaded latency: %0.2f ms (%+0.2f ms)\n", speedtest.Results.LoadedLatency, speedtest.Results.LoadedLatency-speedtest.Results.Latency)
+		}
+	} else {
+		if speedtest.CliFlags.NoDownload {
+			speedtest.Printf("Skipping download test\n")
+		} else {
+			speedtest.Printf("Testing Download Speed")
+			endPhase = speedtest.Phase("download")
+			download := speedtest.Results.Server.TestDownload(config.Download.Length)
+			endPhase()
+			speedtest.recordDownload(download)
+		}
+
+		if speedtest.CliFlags.NoUpload {
+			speedtest.Printf("Skipping upload test\n")
+		} else {
+			speedtest.Printf("Testing Upload Speed")
+			endPhase = speedtest.Phase("upload")
+			upload := speedtest.Results.Server.TestUpload(config.Upload.Length)
+			endPhase()
+			speedtest.recordUpload(upload)
+		}
+	}
+	speedtest.Results.Server.CloseConns()
+
+	plan := Plan{Download: speedtest.CliFlags.PlanDownload, Upload: speedtest.CliFlags.PlanUpload}
+	speedtest.Results.ComparePlan(plan, !speedtest.CliFlags.NoDownload, !speedtest.CliFlags.NoUpload)
+	if p := speedtest.Results.Plan; p != nil {
+		if p.DownloadPercent > 0 {
+			speedtest.Printf("Download is %0.1f%% of the advertised %s\n", p.DownloadPercent, rateUnit.Format(p.Download))
+		}
+		if p.UploadPercent > 0 {
+			speedtest.Printf("Upload is %0.1f%% of the advertised %s\n", p.UploadPercent, rateUnit.Format(p.Upload))
+		}
+	}
+
+	var lineRate float64
+	if speedtest.Results.InterfaceName != "" {
+		if lineRate, err = interfaceSpeed(speedtest.Results.InterfaceName); err != nil {
+			speedtest.Debugf("Could not read the link speed of %s: %s", speedtest.Results.InterfaceName, err)
+		}
+	}
+	if !speedtest.Results.Validate(lineRate, !speedtest.CliFlags.NoDownload, !speedtest.CliFlags.NoUpload) {
+		speedtest.Printf("Results are invalid, %s\n", strings.Join(speedtest.Results.InvalidReasons, ", "))
+	} else if speedtest.Results.Grade = speedtest.Results.ComputeGrade(); speedtest.Results.Grade != nil {
+		speedtest.Printf("Grade: %s\n", speedtest.Results.Grade)
+	}
+
+	if speedtest.CliFlags.SubmitURL != "" && !speedtest.Results.Invalid {
+		if err := speedtest.Results.Submit(speedtest.CliFlags.SubmitURL); err != nil {
+			// Reported on stderr without interactive output, which would
+			// otherwise drop it, keeping stdout parseable
+			if speedtest.CliFlags.Interactive {
+				speedtest.Printf("Could not submit results to %s: %s\n", speedtest.CliFlags.SubmitURL, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Could not submit results to %s: %s\n", speedtest.CliFlags.SubmitURL, err)
+			}
+		} else {
+			speedtest.Printf("Submitted results to %s\n", speedtest.CliFlags.SubmitURL)
+		}
+	}
+
+	if (speedtest.CliFlags.Share || speedtest.CliFlags.ShareSave != "") && !speedtest.Results.Invalid {
+		endPhase = speedtest.Phase("share")
+		if err := speedtest.Results.ToPng(); err == nil && speedtest.CliFlags.ShareSave != "" {
+			if err := speedtest.SaveShareImage(speedtest.Results.Share, speedtest.CliFlags.ShareSave); err != nil {
+				speedtest.Printf("Could not save share results image: %s\n", err)
+			} else {
+				speedtest.Printf("Saved share results image to %s\n", speedtest.CliFlags.ShareSave)
+			}
+		}
+		endPhase()
+	}
+
+	speedtest.Results.BytesSent = atomic.LoadInt64(&speedtest.bytesSent)
+	speedtest.Results.BytesReceived = atomic.LoadInt64(&speedtest.bytesReceived)
+	speedtest.Printf("Data used: %s\n", formatBytes(speedtest.Results.DataUsed()))
+	recordUsage()
+	if speedtest.Results.Approximate {
+		speedtest.Printf("Results are approximate, a quick test was run\n")
+	}
+
+	if speedtest.CliFlags.Anonymize {
+		speedtest.Results.Anonymize()
+	}
+
+	// Read here rather than as the flag default, which usage output prints
+	if speedtest.CliFlags.SignKey == "" {
+		speedtest.CliFlags.SignKey = os.Getenv(signKeyEnv)
+	}
+	if speedtest.CliFlags.SignKey != "" {
+		speedtest.Results.Sign([]byte(speedtest.CliFlags.SignKey))
+	}
+
+	if speedtest.recordMetrics != nil {
+		speedtest.recordMetrics(speedtest.Results)
+	}
+
+	outputs := formatWriters(formats, speedtest.CliFlags.Outputs)
+	for _, f := range speedtest.CliFlags.Outputs {
+		outputs = append(outputs, f)
+	}
+	outputs = append(outputs, enabledOutputWriters()...)
+	if err := speedtest.Results.Write(outputs...); err != nil {
+		errorf(err.Error())
+	}
+
+	if speedtest.CliFlags.PostHook != "" {
+		postHookRan = true
+		status := "success"
+		if speedtest.Results.Invalid {
+			status = "invalid"
+		}
+		env := append(speedtest.Results.Environ(), "SPEEDTEST_STATUS="+status)
+		if err := runHook(speedtest.CliFlags.PostHook, env); err != nil {
+			errorf("Post-hook %q failed: %s", speedtest.CliFlags.PostHook, err)
+		}
+	}
+
+	if speedtest.Results.Invalid {
+		for _, hook := range errorHooks {
+			hook()
+		}
+		os.Exit(invalidExitCode)
+	}
+
+	if speedtest.CliFlags.PingURL != "" {
+		if err := speedtest.PingHealthcheck(""); err != nil {
+			speedtest.Debugf("Could not ping %s: %s", speedtest.CliFlags.PingURL, err)
+		}
 	}
 }
@@ -0,0 +1,76 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"fmt"
+)
+
+// Minimum, average and maximum of a series of values
+type SummaryStats struct {
+	Min   float64 `json:"min"`
+	Avg   float64 `json:"avg"`
+	Max   float64 `json:"max"`
+	count int
+}
+
+func (s *SummaryStats) add(value float64) {
+	if s.count == 0 || value < s.Min {
+		s.Min = value
+	}
+	if s.count == 0 || value > s.Max {
+		s.Max = value
+	}
+	s.Avg = (s.Avg*float64(s.count) + value) / float64(s.count+1)
+	s.count++
+}
+
+// Summary of the runs of a session, such as a serve mode process
+type Summary struct {
+	Runs     int          `json:"runs"`
+	Failures int          `json:"failures"`
+	Download SummaryStats `json:"download"`
+	Upload   SummaryStats `json:"upload"`
+	Latency  SummaryStats `json:"latency"`
+}
+
+// Adds the outcome of a run, results are ignored when err is not nil
+func (s *Summary) Add(results *Results, err error) {
+	s.Runs++
+	if err != nil {
+		s.Failures++
+		return
+	}
+	s.Download.add(results.Download)
+	s.Upload.add(results.Upload)
+	s.Latency.add(results.Latency)
+}
+
+// Fraction of runs that failed
+func (s Summary) FailureRate() float64 {
+	if s.Runs == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Runs)
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("Runs: %d, failed: %d (%.1f%%), download min/avg/max: %.2f/%.2f/%.2f Mbit/s, upload min/avg/max: %.2f/%.2f/%.2f Mbit/s, latency min/avg/max: %.2f/%.2f/%.2f ms",
+		s.Runs, s.Failures, s.FailureRate()*100,
+		s.Download.Min/1000/1000, s.Download.Avg/1000/1000, s.Download.Max/1000/1000,
+		s.Upload.Min/1000/1000, s.Upload.Avg/1000/1000, s.Upload.Max/1000/1000,
+		s.Latency.Min, s.Latency.Avg, s.Latency.Max)
+}
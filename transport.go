@@ -0,0 +1,174 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Endpoint for --transport quic, serving __down?bytes=N and accepting POSTs
+// to __up over HTTP/3
+const defaultQUICURL = "https://speed.cloudflare.com"
+
+// Request body for HTTP/3 uploads, counting data as the transport consumes
+// it and ending early once the test is over
+type quicUploadBody struct {
+	remaining int
+	offset    int
+	state     *transferState
+	worker    int
+	limit     *rateLimiter
+	sent      *int64 // Data sent by the run, as HTTP/3 bypasses countingConn
+}
+
+func (b *quicUploadBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 || b.state.done() {
+		return 0, io.EOF
+	}
+	if len(p) > b.remaining {
+		p = p[:b.remaining]
+	}
+	p = p[:b.limit.chunk(len(p))]
+	b.limit.wait(len(p))
+	n := copy(p, uploadPayload()[b.offset:])
+	b.offset = (b.offset + n) % maxUploadChunkSize
+	b.remaining -= n
+	b.state.add(b.worker, n)
+	atomic.AddInt64(b.sent, int64(n))
+	return n, nil
+}
+
+// Downloads or uploads size bytes over HTTP/3, until the test is over
+func (s *Server) quicRequest(ctx context.Context, phase string, size int, state *transferState, worker int, buf []byte) error {
+	base := strings.TrimSuffix(s.speedtest.CliFlags.QUICURL, "/")
+	var req *http.Request
+	var err error
+	if phase == "download" {
+		req, err = http.NewRequest("GET", base+"/__down?bytes="+strconv.Itoa(size), nil)
+	} else {
+		req, err = http.NewRequest("POST", base+"/__up", &quicUploadBody{remaining: size, state: state, worker: worker, limit: s.speedtest.sendLimit, sent: &s.speedtest.bytesSent})
+	}
+	if err != nil {
+		return err
+	}
+	state.open()
+	res, err := s.speedtest.QUICClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %s", res.Status)
+	}
+
+	// Only the request and response bodies are counted toward the data
+	// used, not the QUIC and HTTP/3 framing around them
+	if phase == "upload" {
+		n, err := io.Copy(ioutil.Discard, res.Body)
+		atomic.AddInt64(&s.speedtest.bytesReceived, n)
+		return err
+	}
+	limit := s.speedtest.receiveLimit
+	for !state.done() {
+		n, err := res.Body.Read(buf[:limit.chunk(len(buf))])
+		state.add(worker, n)
+		atomic.AddInt64(&s.speedtest.bytesReceived, int64(n))
+		limit.wait(n)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs a download or upload test over HTTP/3 for --transport quic, with the
+// same sizes, threads and measurement window as the TCP tests
+func (s *Server) testQUIC(phase string, sizes Sizes, length float64) *Transfer {
+	ci := make(chan int)
+	wg := new(sync.WaitGroup)
+	state := newTransferState(length, s.speedtest.CliFlags.Ramp, s.speedtest.Threads)
+
+	// Bounds requests that stall, as HTTP/3 streams have no I/O deadlines
+	ctx, cancel := context.WithTimeout(context.Background(), state.length+state.ramp+s.speedtest.Timeout)
+	defer cancel()
+
+	cpuStart, _ := processCPUTime()
+	rxStart, txStart, ifOK := s.speedtest.interfaceSnapshot()
+
+	for i := 0; i < s.speedtest.Threads; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			bufp := s.speedtest.readBuffers.Get().(*[]byte)
+			defer s.speedtest.readBuffers.Put(bufp)
+
+			for size := range ci {
+				s.speedtest.Printf(".")
+				if state.done() || s.budgetExhausted(state) {
+					continue
+				}
+				if err := s.quicRequest(ctx, phase, size, state, worker, *bufp); err != nil && !state.done() {
+					s.speedtest.Debugf("HTTP/3 %s request failed: %s", phase, err)
+				}
+			}
+		}(i)
+	}
+
+	stop := make(chan struct{})
+	samples := make(chan []float64)
+	s.speedtest.progress(ProgressEvent{Type: "start", Phase: phase})
+	go s.sampleRate(phase, state, time.Second, stop, samples)
+
+	for _, size := range sizes {
+		for i := 0; i < requestsPerSize; i++ {
+			ci <- size
+		}
+	}
+	close(ci)
+	wg.Wait()
+
+	total := state.window(time.Now())
+	close(stop)
+	s.speedtest.Printf("\n")
+
+	transfer := &Transfer{
+		Bytes:    state.transferred(),
+		Duration: total,
+		Samples:  <-samples,
+		CPUUsage: cpuUsage(cpuStart, state.start),
+	}
+	transfer.Connections = state.connections(total)
+	if rxEnd, txEnd, ok := s.speedtest.interfaceSnapshot(); ok && ifOK {
+		if phase == "download" {
+			transfer.InterfaceBytes = rxEnd - rxStart
+		} else {
+			transfer.InterfaceBytes = txEnd - txStart
+		}
+	}
+	s.speedtest.progressEnd(phase, state, transfer)
+	return transfer
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const kmPerMile = 1.609344
+
+// Unit that distances are displayed in. Distances are always kept and
+// emitted in JSON and XML in km.
+type DistanceUnit string
+
+const (
+	Kilometers DistanceUnit = "km"
+	Miles      DistanceUnit = "mi"
+)
+
+func parseDistanceUnit(value string) (DistanceUnit, error) {
+	switch unit := DistanceUnit(value); unit {
+	case Kilometers, Miles:
+		return unit, nil
+	}
+	return "", fmt.Errorf("Invalid distance unit %s, must be km or mi", value)
+}
+
+// Converts a distance in km to the unit
+func (u DistanceUnit) FromKm(km float64) float64 {
+	if u == Miles {
+		return km / kmPerMile
+	}
+	return km
+}
+
+// Distance in km formatted in the unit, for display
+func (u DistanceUnit) Format(km float64) string {
+	if u == "" {
+		u = Kilometers
+	}
+	return fmt.Sprintf("%0.2f %s", u.FromKm(km), u)
+}
+
+// Unit that speeds are displayed in. Speeds are always kept and emitted
+// in JSON, XML and CSV in bit/s.
+type RateUnit string
+
+const (
+	AutoRate RateUnit = "auto"
+	Kbits    RateUnit = "kbit"
+	Mbits    RateUnit = "mbit"
+	Gbits    RateUnit = "gbit"
+)
+
+func parseRateUnit(value string) (RateUnit, error) {
+	switch unit := RateUnit(value); unit {
+	case AutoRate, Kbits, Mbits, Gbits:
+		return unit, nil
+	}
+	return "", fmt.Errorf("Invalid speed unit %s, must be auto, kbit, mbit or gbit", value)
+}
+
+// Speed in bit/s formatted in the unit, for display. Auto picks the
+// largest unit that keeps the value at or above 1
+func (u RateUnit) Format(bps float64) string {
+	switch u {
+	case "", AutoRate:
+		switch {
+		case bps >= 1000*1000*1000:
+			u = Gbits
+		case bps >= 1000*1000:
+			u = Mbits
+		default:
+			u = Kbits
+		}
+	}
+	switch u {
+	case Kbits:
+		return fmt.Sprintf("%0.2f Kbit/s", bps/1000)
+	case Gbits:
+		return fmt.Sprintf("%0.2f Gbit/s", bps/1000/1000/1000)
+	}
+	return fmt.Sprintf("%0.2f Mbit/s", bps/1000/1000)
+}
+
+// Speed in bit/s, accepting kbit, mbit and gbit unit suffixes, optionally
+// followed by /s or written as kbps, mbps and gbps. Plain numbers are in
+// Mbit/s, as plans are usually advertised in.
+type Rate float64
+
+var rateSuffixes = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"kbit/s", 1000},
+	{"mbit/s", 1000 * 1000},
+	{"gbit/s", 1000 * 1000 * 1000},
+	{"kbit", 1000},
+	{"mbit", 1000 * 1000},
+	{"gbit", 1000 * 1000 * 1000},
+	{"kbps", 1000},
+	{"mbps", 1000 * 1000},
+	{"gbps", 1000 * 1000 * 1000},
+	{"k", 1000},
+	{"m", 1000 * 1000},
+	{"g", 1000 * 1000 * 1000},
+}
+
+func (r *Rate) String() string {
+	if *r == 0 {
+		return ""
+	}
+	return RateUnit(AutoRate).Format(float64(*r))
+}
+
+func (r *Rate) Set(value string) error {
+	number := strings.ToLower(strings.TrimSpace(value))
+	multiplier := float64(1000 * 1000)
+	for _, unit := range rateSuffixes {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	rate, err := strconv.ParseFloat(number, 64)
+	if err != nil || rate < 0 {
+		return fmt.Errorf("invalid speed %s", value)
+	}
+	*r = Rate(rate * multiplier)
+	return nil
+}
+
+// Reads a speed from JSON as a string such as "500mbit", or a number in
+// Mbit/s
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case string:
+		return r.Set(v)
+	case float64:
+		return r.Set(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return fmt.Errorf("invalid speed %s", b)
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Data used by test runs in a calendar month
+type MonthUsage struct {
+	Runs          int   `json:"runs"`
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+}
+
+func (u *MonthUsage) Total() int64 {
+	return u.BytesSent + u.BytesReceived
+}
+
+// Data used by test runs by month, keyed by YYYY-MM in local time
+type Usage map[string]*MonthUsage
+
+func usageMonth(t time.Time) string {
+	return t.Local().Format("2006-01")
+}
+
+// Data used in the month of t, zero when there were no runs
+func (u Usage) Month(t time.Time) *MonthUsage {
+	if month, ok := u[usageMonth(t)]; ok {
+		return month
+	}
+	return &MonthUsage{}
+}
+
+// Path of the usage file, kept alongside the default configuration file
+func usagePath() (string, error) {
+	config, err := defaultConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(config), "usage.json"), nil
+}
+
+// Reads the data used by past runs, which is empty before the first run
+func LoadUsage() (Usage, error) {
+	usage := Usage{}
+	path, err := usagePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return usage, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return usage, nil
+}
+
+// Adds the data used by a run at t to its month. The file is replaced rather
+// than written in place, so an interrupted write cannot lose past months.
+func RecordUsage(t time.Time, sent, received int64) error {
+	usage, err := LoadUsage()
+	if err != nil {
+		return err
+	}
+	month := usage.Month(t)
+	month.Runs++
+	month.BytesSent += sent
+	month.BytesReceived += received
+	usage[usageMonth(t)] = month
+
+	path, err := usagePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(usage, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func dataUsageUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, `usage: %s usage [options]
+
+Show the data used by test runs in each calendar month, and how much of the
+monthly budget, if one is configured, has been used this month.
+
+options:
+`, path.Base(os.Args[0]))
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+}
+
+// Entry point of the usage subcommand
+func dataUsage(args []string) {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	fs.Usage = dataUsageUsage(fs)
+	months := fs.Int("months", 12, "Show only the latest N months, 0 shows all months")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+	}
+
+	usage, err := LoadUsage()
+	if err != nil {
+		errorf("Could not read data usage: %s", err)
+	}
+	config, err := LoadDefaultConfig()
+	if err != nil {
+		errorf("Could not read configuration: %s", err)
+	}
+
+	var keys []string
+	for key := range usage {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if *months > 0 && len(keys) > *months {
+		keys = keys[len(keys)-*months:]
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MONTH\tRUNS\tSENT\tRECEIVED\tTOTAL")
+	for _, key := range keys {
+		month := usage[key]
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", key, month.Runs,
+			formatBytes(month.BytesSent), formatBytes(month.BytesReceived), formatBytes(month.Total()))
+	}
+	tw.Flush()
+
+	if budget := int64(config.MonthlyBudget); budget > 0 {
+		used := usage.Month(time.Now()).Total()
+		fmt.Printf("\nMonthly budget: %s of %s used (%.0f%%)\n", formatBytes(used), formatBytes(budget), float64(used)/float64(budget)*100)
+	}
+}
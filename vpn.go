@@ -0,0 +1,50 @@
+// Copyright 2016 Matt Martz <matt@sivel.net>
+// All Rights Reserved.
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Name prefixes of interfaces created by VPN and tunneling software, such as
+// OpenVPN, WireGuard, PPP, macOS utun, Tailscale, ZeroTier, NordVPN, Cisco
+// AnyConnect and GlobalProtect
+var tunnelPrefixes = []string{"tun", "tap", "wg", "ppp", "utun", "ipsec", "gre", "vti", "vpn", "tailscale", "zt", "nordlynx", "cscotun", "gpd"}
+
+// Reasons to believe the test traffic is routed over a VPN or tunnel rather
+// than directly over the ISP link, empty when there are none. expectISP is
+// the ISP the client is expected to be reported with, if known.
+func tunnelReasons(iface string, client *Client, expectISP string) []string {
+	var reasons []string
+	if iface != "" {
+		name := strings.ToLower(iface)
+		for _, prefix := range tunnelPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				reasons = append(reasons, fmt.Sprintf("interface %s is named like a tunnel", iface))
+				break
+			}
+		}
+		if kind, err := interfaceTunnel(iface); err == nil && kind != "" {
+			reasons = append(reasons, fmt.Sprintf("interface %s is a %s device", iface, kind))
+		}
+	}
+	if expectISP != "" && client != nil && client.ISP != "" &&
+		!strings.Contains(strings.ToLower(client.ISP), strings.ToLower(expectISP)) {
+		reasons = append(reasons, fmt.Sprintf("reported ISP %s is not the expected %s", client.ISP, expectISP))
+	}
+	return reasons
+}